@@ -1,8 +1,10 @@
 package pixiu_router_update
 
 import (
+	"context"
 	"math/rand"
 	"net/http"
+	"runtime"
 	"strconv"
 	"testing"
 )
@@ -10,6 +12,7 @@ import (
 import (
 	newrouter "github.com/alanxtl/pixiu-router-update/new"
 	newmodel "github.com/alanxtl/pixiu-router-update/new/model"
+	newtrie "github.com/alanxtl/pixiu-router-update/new/trie"
 	oldrouter "github.com/alanxtl/pixiu-router-update/old"
 	oldmodel "github.com/alanxtl/pixiu-router-update/old/model"
 )
@@ -316,6 +319,8 @@ func BenchmarkReload_Latency(b *testing.B) {
 			for _, r := range buildDeltaNew(newBase, int64(i)) {
 				newc.OnAddRouter(r)
 			}
+			// measure the publish, not only the scheduling
+			_ = newc.Flush(context.Background())
 		}
 	})
 }
@@ -416,6 +421,8 @@ func BenchmarkReload_100k_Latency_1Percent(b *testing.B) {
 			for _, r := range buildDeltaNew(newBase, int64(i)) {
 				newc.OnAddRouter(r)
 			}
+			// measure the publish, not only the scheduling
+			_ = newc.Flush(context.Background())
 		}
 	})
 }
@@ -458,3 +465,99 @@ func BenchmarkRouteByPathAndName(b *testing.B) {
 		}
 	})
 }
+
+// ============= Bench 5：trie layout vs radix layout of a snapshot =============
+
+func genTrieKeys(n int) []string {
+	keys := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if i%5 < 2 {
+			keys = append(keys, "GET/api/v1/service"+strconv.Itoa(i%50)+"/**")
+			continue
+		}
+		keys = append(keys, "GET/api/v1/item/"+strconv.Itoa(i))
+	}
+	keys = append(keys, "GET/api/v1/users/:id/orders/:oid")
+	return keys
+}
+
+func BenchmarkSnapshot_TrieVsRadix(b *testing.B) {
+	t := newtrie.NewTrie[int]()
+	for i, k := range genTrieKeys(100_000) {
+		_, _ = t.Put(k, i)
+	}
+	it := t.Freeze()
+	rt := newtrie.CompileRadix(&it, nil)
+	paths := []string{
+		"GET/api/v1/item/12345",
+		"GET/api/v1/service7/foo/bar",
+		"GET/api/v1/users/42/orders/7",
+		"GET/unknown/path",
+	}
+
+	b.Run("trie/match-100k", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _, _ = it.Match(paths[i%len(paths)])
+		}
+	})
+
+	b.Run("radix/match-100k", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _, _ = rt.Match(paths[i%len(paths)])
+		}
+	})
+
+	b.Run("radix/compile-100k", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = newtrie.CompileRadix(&it, nil)
+		}
+	})
+
+	// a snapshot keeps both layouts, the radix reuses the trie nodes of unchanged subtrees on the next publish
+	b.Run("heap-100k", func(b *testing.B) {
+		keys := genTrieKeys(100_000)
+		var trieBytes, radixBytes uint64
+		for i := 0; i < b.N; i++ {
+			before := heapInUse()
+			t := newtrie.NewTrie[int]()
+			for j, k := range keys {
+				_, _ = t.Put(k, j)
+			}
+			it := t.Freeze()
+			afterTrie := heapInUse()
+			rt := newtrie.CompileRadix(&it, nil)
+			afterRadix := heapInUse()
+			runtime.KeepAlive(rt)
+			trieBytes += afterTrie - before
+			radixBytes += afterRadix - afterTrie
+		}
+		b.ReportMetric(float64(trieBytes)/float64(b.N*len(keys)), "trie-B/route")
+		b.ReportMetric(float64(radixBytes)/float64(b.N*len(keys)), "radix-B/route")
+	})
+
+	b.Run("radix/recompile-1percent-100k", func(b *testing.B) {
+		rnd := rand.New(rand.NewSource(1))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			next := it.Thaw()
+			for j := 0; j < 1000; j++ {
+				_, _ = next.PutOrUpdate("GET/api/v1/item/"+strconv.Itoa(rnd.Intn(100_000)), j)
+			}
+			frozen := next.Freeze()
+			b.StartTimer()
+			_ = newtrie.CompileRadix(&frozen, rt)
+		}
+	})
+}
+
+// heapInUse the live heap after a collection
+func heapInUse() uint64 {
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
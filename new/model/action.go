@@ -0,0 +1,233 @@
+package model
+
+import (
+	stdHttp "net/http"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/pkg/errors"
+)
+
+import (
+	util "github.com/alanxtl/pixiu-router-update/utils"
+)
+
+// ActionKind what a RouteAction does with the request
+type ActionKind int
+
+const (
+	ActionCluster        ActionKind = iota // forward to Cluster or WeightedClusters
+	ActionRedirect                         // answer with Redirect
+	ActionDirectResponse                   // answer with DirectResponse
+)
+
+// Kind what the action does with the request
+func (a *RouteAction) Kind() ActionKind {
+	switch {
+	case a.Redirect != nil:
+		return ActionRedirect
+	case a.DirectResponse != nil:
+		return ActionDirectResponse
+	}
+	return ActionCluster
+}
+
+// validateAction at most one of WeightedClusters, Redirect and DirectResponse, with valid status codes
+func validateAction(a *RouteAction) error {
+	set := 0
+	for _, ok := range []bool{a.WeightedClusters != nil, a.Redirect != nil, a.DirectResponse != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set > 1 {
+		return errors.New("only one of weighted_clusters, redirect and direct_response can be set")
+	}
+	if r := a.Redirect; r != nil {
+		switch r.ResponseCode {
+		case 0, stdHttp.StatusMovedPermanently, stdHttp.StatusFound, stdHttp.StatusSeeOther,
+			stdHttp.StatusTemporaryRedirect, stdHttp.StatusPermanentRedirect:
+		default:
+			return errors.Errorf("redirect: invalid response code %d", r.ResponseCode)
+		}
+		if r.Path != "" && !strings.HasPrefix(r.Path, "/") {
+			return errors.Errorf("redirect: path %s must start with /", r.Path)
+		}
+	}
+	if d := a.DirectResponse; d != nil && d.Status != 0 && (d.Status < 100 || d.Status > 599) {
+		return errors.Errorf("direct response: invalid status %d", d.Status)
+	}
+	if a.PrefixRewrite != "" || a.RegexRewrite != nil {
+		if a.Kind() != ActionCluster {
+			return errors.New("rewrites only apply to actions forwarding to a cluster")
+		}
+		if a.PrefixRewrite != "" && a.RegexRewrite != nil {
+			return errors.New("only one of prefix_rewrite and regex_rewrite can be set")
+		}
+		if a.PrefixRewrite != "" && !strings.HasPrefix(a.PrefixRewrite, "/") {
+			return errors.Errorf("prefix rewrite %s must start with /", a.PrefixRewrite)
+		}
+		if rw := a.RegexRewrite; rw != nil && getCachedRegexp(rw.Pattern) == nil {
+			return errors.Errorf("regex rewrite: invalid pattern %s", rw.Pattern)
+		}
+	}
+	return nil
+}
+
+// rewritePath the path forwarded upstream for the request path of a route matching prefix (empty for Path / Regex routes)
+// with the path variables params
+func (a *RouteAction) rewritePath(path, prefix string, params map[string]string) string {
+	switch {
+	case a.PrefixRewrite != "":
+		if prefix == "" {
+			return a.PrefixRewrite
+		}
+		rest, ok := dropSegments(path, len(util.Split(strings.TrimSuffix(prefix, "/"))))
+		if !ok {
+			return path
+		}
+		if rest == "" {
+			return a.PrefixRewrite
+		}
+		return strings.TrimSuffix(a.PrefixRewrite, "/") + rest
+	case a.RegexRewrite != nil:
+		re := getCachedRegexp(a.RegexRewrite.Pattern)
+		if re == nil {
+			return path
+		}
+		return re.ReplaceAllString(path, expandPathVariables(a.RegexRewrite.Substitution, params))
+	}
+	return path
+}
+
+// dropSegments path without its first n segments, the rest starts with / or is empty
+func dropSegments(path string, n int) (string, bool) {
+	i := 0
+	for ; n > 0; n-- {
+		for i < len(path) && path[i] == '/' {
+			i++
+		}
+		if i == len(path) {
+			return "", false
+		}
+		j := strings.IndexByte(path[i:], '/')
+		if j < 0 {
+			i = len(path)
+			continue
+		}
+		i += j
+	}
+	return path[i:], true
+}
+
+// expandPathVariables replace the {name} references of s by the path variables, $ in the values is escaped for regexp expansion.
+// ${name} is a capture group reference of the regexp and is left alone, $${name} is a literal $ before a path variable.
+func expandPathVariables(s string, params map[string]string) string {
+	if len(params) == 0 || !strings.Contains(s, "{") {
+		return s
+	}
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '{')
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			break
+		}
+		v, ok := params[s[i+1:i+j]]
+		if !ok || dollars(s[:i])%2 == 1 {
+			b.WriteString(s[:i+j+1])
+			s = s[i+j+1:]
+			continue
+		}
+		b.WriteString(s[:i])
+		b.WriteString(strings.ReplaceAll(v, "$", "$$"))
+		s = s[i+j+1:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// dollars the number of $ s ends with
+func dollars(s string) int {
+	return len(s) - len(strings.TrimRight(s, "$"))
+}
+
+// Location the redirect target of req
+func (r *RedirectAction) Location(req *stdHttp.Request) string {
+	scheme := r.Scheme
+	if scheme == "" {
+		scheme = requestScheme(req)
+	}
+	host := r.Host
+	if host == "" {
+		host = req.Host
+		if host == "" {
+			host = req.URL.Host
+		}
+		if r.Scheme != "" {
+			// the default port of the old scheme does not fit the new one
+			host = strings.TrimSuffix(strings.TrimSuffix(host, ":80"), ":443")
+		}
+	}
+	path := r.Path
+	if path == "" {
+		path = req.URL.EscapedPath()
+	}
+	var b strings.Builder
+	b.WriteString(scheme)
+	b.WriteString("://")
+	b.WriteString(host)
+	b.WriteString(path)
+	if !r.StripQuery && req.URL.RawQuery != "" {
+		b.WriteByte('?')
+		b.WriteString(req.URL.RawQuery)
+	}
+	return b.String()
+}
+
+func requestScheme(req *stdHttp.Request) string {
+	if req.URL.Scheme != "" {
+		return req.URL.Scheme
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// Respond write the redirect or the direct response of the action to w, false for actions forwarding to a cluster
+func (a *RouteAction) Respond(w stdHttp.ResponseWriter, req *stdHttp.Request) bool {
+	switch a.Kind() {
+	case ActionRedirect:
+		code := a.Redirect.ResponseCode
+		if code == 0 {
+			code = stdHttp.StatusMovedPermanently
+		}
+		w.Header().Set("Location", a.Redirect.Location(req))
+		w.WriteHeader(code)
+		return true
+	case ActionDirectResponse:
+		d := a.DirectResponse
+		for k, v := range d.Headers {
+			w.Header().Set(k, v)
+		}
+		if d.Body != "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(d.Body)))
+		}
+		status := d.Status
+		if status == 0 {
+			status = stdHttp.StatusOK
+		}
+		w.WriteHeader(status)
+		if d.Body != "" && req.Method != stdHttp.MethodHead {
+			_, _ = w.Write([]byte(d.Body))
+		}
+		return true
+	}
+	return false
+}
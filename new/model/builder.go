@@ -0,0 +1,281 @@
+package model
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+)
+
+import (
+	"github.com/alanxtl/pixiu-router-update/new/trie"
+)
+
+// SnapshotBuilder derives a new RouteSnapshot from a published one.
+// Method tries are thawed copy-on-write, only the trie paths touched by the
+// changes are copied, every untouched subtree stays shared with the base snapshot.
+type SnapshotBuilder struct {
+	next   *RouteSnapshot
+	tables map[string]*tableEdit // route tables of the changed virtual hosts, by name
+}
+
+// tableEdit pending changes of the route table of one virtual host
+type tableEdit struct {
+	next  *RouteTable
+	tries map[string]*trie.Trie[*TrieLeaf] // thawed tries of the changed methods, frozen by Build
+
+	header listEdit[HeaderRoute]
+	regex  listEdit[RegexRoute]
+}
+
+// NewSnapshotBuilder start a builder on top of base, base itself is never modified
+func NewSnapshotBuilder(base *RouteSnapshot) *SnapshotBuilder {
+	next := &RouteSnapshot{
+		Hosts:   maps.Clone(base.Hosts),
+		Domains: base.Domains,
+	}
+	if next.Hosts == nil {
+		next.Hosts = make(map[string]*RouteTable, 1)
+	}
+	return &SnapshotBuilder{
+		next:   next,
+		tables: make(map[string]*tableEdit, 1),
+	}
+}
+
+// SetDomains replace the domains of the virtual hosts
+func (b *SnapshotBuilder) SetDomains(idx DomainIndex) {
+	b.next.Domains = idx
+}
+
+// SetTrieKey put or replace the leaf stored under key
+func (b *SnapshotBuilder) SetTrieKey(key TrieKey, leaf *TrieLeaf) {
+	_, _ = b.table(key.Host).trie(key.Method).PutOrUpdate(key.Key, leaf)
+}
+
+// SwapAction replace the entry of the route e.ID in the leaf stored under key, keeping its conditions and position.
+// The trie keeps its shape, only the path to the leaf is copied. False when the leaf has no candidate of the route.
+func (b *SnapshotBuilder) SwapAction(key TrieKey, e *RouteEntry) bool {
+	te := b.table(key.Host)
+	if te.next.MethodTries[key.Method] == nil && te.tries[key.Method] == nil {
+		return false
+	}
+	t := te.trie(key.Method)
+	node, _, _, _ := t.Get(key.Key)
+	if node == nil {
+		return false
+	}
+	leaf := node.GetBizInfo()
+	if leaf == nil {
+		return false
+	}
+	i := slices.IndexFunc(leaf.Candidates, func(c TrieCandidate) bool { return c.ID == e.ID })
+	if i < 0 {
+		return false
+	}
+	next := &TrieLeaf{Candidates: slices.Clone(leaf.Candidates)}
+	next.Candidates[i].RouteEntry = e
+	_, _ = t.PutOrUpdate(key.Key, next)
+	return true
+}
+
+// DeleteTrieKey remove the leaf stored under key
+func (b *SnapshotBuilder) DeleteTrieKey(key TrieKey) {
+	te := b.table(key.Host)
+	if te.next.MethodTries[key.Method] == nil && te.tries[key.Method] == nil {
+		return
+	}
+	_, _ = te.trie(key.Method).Remove(key.Key)
+}
+
+// AddScanRoute add a header-only or regex route of host inserted at seq, it is placed by its priority and seq
+func (b *SnapshotBuilder) AddScanRoute(host string, r *Router, seq uint64) {
+	te := b.table(host)
+	switch KindOf(r) {
+	case KindHeaderOnly:
+		if hr, ok := compileHeaderRoute(r, seq); ok {
+			te.header.add = append(te.header.add, hr)
+		}
+	case KindRegex:
+		if rr, ok := compileRegexRoute(r, seq); ok {
+			te.regex.add = append(te.regex.add, rr)
+		}
+	}
+}
+
+// ReplaceScanRoute update a header-only or regex route of host inserted at seq, its position follows its priority and seq
+func (b *SnapshotBuilder) ReplaceScanRoute(host string, r *Router, seq uint64) {
+	te := b.table(host)
+	switch KindOf(r) {
+	case KindHeaderOnly:
+		hr, ok := compileHeaderRoute(r, seq)
+		te.header.replace(r.ID, hr, ok)
+	case KindRegex:
+		rr, ok := compileRegexRoute(r, seq)
+		te.regex.replace(r.ID, rr, ok)
+	}
+}
+
+// RemoveScanRoute remove the header-only or regex route of host with the given id
+func (b *SnapshotBuilder) RemoveScanRoute(host, id string, kind RouteKind) {
+	te := b.table(host)
+	switch kind {
+	case KindHeaderOnly:
+		te.header.remove(id)
+	case KindRegex:
+		te.regex.remove(id)
+	}
+}
+
+// Build return the new snapshot, the builder must not be used afterwards.
+// Tables of virtual hosts left without routes are dropped, except the one of DefaultHost.
+func (b *SnapshotBuilder) Build() *RouteSnapshot {
+	for host, te := range b.tables {
+		t := te.build()
+		if host != DefaultHost && t.IsEmpty() {
+			delete(b.next.Hosts, host)
+			continue
+		}
+		b.next.Hosts[host] = t
+	}
+	return b.next
+}
+
+// table get the pending changes of host, copy its route table on first use
+func (b *SnapshotBuilder) table(host string) *tableEdit {
+	if te := b.tables[host]; te != nil {
+		return te
+	}
+	next := &RouteTable{}
+	if base := b.next.Hosts[host]; base != nil {
+		*next = *base
+	}
+	next.MethodTries = maps.Clone(next.MethodTries)
+	if next.MethodTries == nil {
+		next.MethodTries = make(map[string]*trie.ImmutableTrie[*TrieLeaf], 8)
+	}
+	next.MethodRadix = maps.Clone(next.MethodRadix)
+	if next.MethodRadix == nil {
+		next.MethodRadix = make(map[string]*trie.Radix[*TrieLeaf], 8)
+	}
+	te := &tableEdit{next: next, tries: make(map[string]*trie.Trie[*TrieLeaf], 8)}
+	b.tables[host] = te
+	return te
+}
+
+func (te *tableEdit) build() *RouteTable {
+	for m, t := range te.tries {
+		if t.IsEmpty() {
+			delete(te.next.MethodTries, m)
+			delete(te.next.MethodRadix, m)
+			continue
+		}
+		it := t.Freeze()
+		te.next.MethodTries[m] = &it
+		// the radix of the base snapshot lends its subtrees the changes did not touch
+		te.next.MethodRadix[m] = trie.CompileRadix(&it, te.next.MethodRadix[m])
+	}
+	if te.header.changed() {
+		te.next.HeaderOnly = te.header.apply(te.next.HeaderOnly)
+		te.next.HeaderIndex = nil
+		if len(te.next.HeaderOnly) > 0 {
+			te.next.HeaderIndex = NewHeaderIndex(te.next.HeaderOnly)
+		}
+	}
+	te.next.Regex = te.regex.apply(te.next.Regex)
+	return te.next
+}
+
+// trie get the mutable trie of method, thaw it on first use
+func (te *tableEdit) trie(method string) *trie.Trie[*TrieLeaf] {
+	if t := te.tries[method]; t != nil {
+		return t
+	}
+	var nt trie.Trie[*TrieLeaf]
+	if it := te.next.MethodTries[method]; it != nil {
+		nt = it.Thaw()
+	} else {
+		nt = trie.NewTrie[*TrieLeaf]()
+	}
+	te.tries[method] = &nt
+	return &nt
+}
+
+// scanRoute a route of a scanned list
+type scanRoute interface {
+	routeID() string
+	priority() int
+	order() uint64
+}
+
+// listEdit pending changes of a scanned route list, applied on a copy of the list
+type listEdit[T scanRoute] struct {
+	drop     map[string]struct{} // removed, by route id
+	replaced map[string]T        // updated in place, by route id
+	add      []T
+}
+
+func (e *listEdit[T]) remove(id string) {
+	if e.drop == nil {
+		e.drop = make(map[string]struct{})
+	}
+	e.drop[id] = struct{}{}
+}
+
+// replace update the route in place, or remove it if the new version can not be compiled
+func (e *listEdit[T]) replace(id string, v T, ok bool) {
+	if !ok {
+		e.remove(id)
+		return
+	}
+	if e.replaced == nil {
+		e.replaced = make(map[string]T)
+	}
+	e.replaced[id] = v
+}
+
+// changed the list has pending changes
+func (e *listEdit[T]) changed() bool {
+	return len(e.drop) > 0 || len(e.replaced) > 0 || len(e.add) > 0
+}
+
+func (e *listEdit[T]) apply(old []T) []T {
+	if !e.changed() {
+		return old
+	}
+	out := make([]T, 0, len(old)+len(e.add))
+	seen := 0
+	for _, v := range old {
+		if _, drop := e.drop[v.routeID()]; drop {
+			continue
+		}
+		if nv, ok := e.replaced[v.routeID()]; ok {
+			v = nv
+			seen++
+		}
+		out = append(out, v)
+	}
+	if seen < len(e.replaced) {
+		// the previous version was not in the list (it did not compile), sortByPriority places the new one by its seq
+		for _, v := range e.replaced {
+			if !slices.ContainsFunc(out, func(o T) bool { return o.routeID() == v.routeID() }) {
+				out = append(out, v)
+			}
+		}
+	}
+	out = append(out, e.add...)
+	sortByPriority(out)
+	return out
+}
+
+// sortByPriority order a scanned list by priority, higher first, then in insertion order
+func sortByPriority[T scanRoute](routes []T) {
+	slices.SortFunc(routes, func(a, b T) int {
+		return cmp.Or(cmp.Compare(b.priority(), a.priority()), cmp.Compare(a.order(), b.order()))
+	})
+}
+
+func (e RouteEntry) routeID() string { return e.ID }
+func (e RouteEntry) priority() int   { return e.Priority }
+
+func (hr HeaderRoute) order() uint64 { return hr.seq }
+func (rr RegexRoute) order() uint64  { return rr.seq }
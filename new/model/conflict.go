@@ -0,0 +1,86 @@
+package model
+
+import (
+	"cmp"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// Conflict routes of one trie key that can never match because an earlier candidate always wins over them
+type Conflict struct {
+	Key    TrieKey
+	Winner string // id of the first candidate
+	// ids of the routes behind a candidate without headers, query parameters and cookies
+	Shadowed []string
+	// ids of the routes with the same priority and conditions as an earlier candidate
+	Duplicates []string
+}
+
+// Conflict the unreachable candidates of the leaf stored under key, false if every candidate can match
+func (l *TrieLeaf) Conflict(key TrieKey) (Conflict, bool) {
+	if len(l.Candidates) < 2 {
+		return Conflict{}, false
+	}
+	c := Conflict{Key: key, Winner: l.Candidates[0].ID}
+	open := true // no earlier candidate matches unconditionally
+	seen := make(map[string]struct{}, len(l.Candidates))
+	for i := range l.Candidates {
+		cand := &l.Candidates[i]
+		_, dup := seen[cand.conditions]
+		switch {
+		case dup:
+			c.Duplicates = append(c.Duplicates, cand.ID)
+		case !open:
+			c.Shadowed = append(c.Shadowed, cand.ID)
+		}
+		seen[cand.conditions] = struct{}{}
+		if !cand.Conditional() {
+			open = false
+		}
+	}
+	return c, len(c.Shadowed) > 0 || len(c.Duplicates) > 0
+}
+
+// SortConflicts order conflicts by virtual host, method and key
+func SortConflicts(conflicts []Conflict) {
+	slices.SortFunc(conflicts, func(a, b Conflict) int {
+		return cmp.Or(cmp.Compare(a.Key.Host, b.Key.Host), cmp.Compare(a.Key.Method, b.Key.Method), cmp.Compare(a.Key.Key, b.Key.Key))
+	})
+}
+
+// conditionKey the priority and the conditions of c, candidates with the same key match exactly the same requests on the same trie key
+func conditionKey(c *TrieCandidate) string {
+	b := strconv.AppendInt(nil, int64(c.Priority), 10)
+	for _, h := range c.Headers {
+		b = appendCondition(append(b, "|h"...), h.Name, h.Regex, h.Values)
+		b = strconv.AppendQuote(append(b, ' '), h.Pattern)
+		b = strconv.AppendInt(append(b, ' '), int64(h.Kind), 10)
+		b = strconv.AppendInt(append(b, ' '), h.Start, 10)
+		b = strconv.AppendInt(append(b, ' '), h.End, 10)
+		b = strconv.AppendBool(append(b, ' '), h.IgnoreCase)
+		b = strconv.AppendBool(append(b, ' '), h.Invert)
+	}
+	for _, q := range c.Query {
+		b = appendCondition(append(b, "|q"...), q.Name, q.Regex, q.Values)
+		b = strconv.AppendBool(append(b, ' '), q.Absent)
+	}
+	for _, k := range c.Cookies {
+		b = appendCondition(append(b, "|c"...), k.Name, k.Regex, k.Values)
+	}
+	return string(b)
+}
+
+// appendCondition append the quoted name, regexp source (- without) and values of a condition to b
+func appendCondition(b []byte, name string, re *regexp.Regexp, values []string) []byte {
+	b = strconv.AppendQuote(b, name)
+	if re == nil {
+		b = append(b, " -"...)
+	} else {
+		b = strconv.AppendQuote(append(b, ' '), re.String())
+	}
+	for _, v := range values {
+		b = strconv.AppendQuote(append(b, ' '), v)
+	}
+	return b
+}
@@ -0,0 +1,90 @@
+package model
+
+import (
+	stdHttp "net/http"
+)
+
+// HeaderIndex the header-only routes of a RouteTable by the exact values of one of their headers,
+// the routes without a header of exact values are scanned
+type HeaderIndex struct {
+	keys []headerKeys
+	scan []int32 // positions in HeaderOnly, ascending
+}
+
+// headerKeys the routes indexed under one header name
+type headerKeys struct {
+	name    string             // canonical header name
+	byValue map[string][]int32 // header value -> positions in HeaderOnly of the routes accepting it, ascending
+}
+
+// NewHeaderIndex index routes, a route is indexed under the first of its headers with exact values
+func NewHeaderIndex(routes []HeaderRoute) *HeaderIndex {
+	x := &HeaderIndex{}
+	for i := range routes {
+		pos := int32(i)
+		h, ok := indexedHeader(routes[i].Headers)
+		if !ok {
+			x.scan = append(x.scan, pos)
+			continue
+		}
+		k := x.key(h.Name)
+		for _, v := range h.Values {
+			// an empty header never matches
+			if v == "" {
+				continue
+			}
+			if ps := k.byValue[v]; len(ps) == 0 || ps[len(ps)-1] != pos {
+				k.byValue[v] = append(ps, pos)
+			}
+		}
+	}
+	return x
+}
+
+// indexedHeader first header matched by exact, case-sensitive values
+func indexedHeader(headers []CompiledHeader) (*CompiledHeader, bool) {
+	for i := range headers {
+		if h := &headers[i]; h.Kind == HeaderExact && !h.IgnoreCase && !h.Invert {
+			return h, true
+		}
+	}
+	return nil, false
+}
+
+func (x *HeaderIndex) key(name string) *headerKeys {
+	for i := range x.keys {
+		if x.keys[i].name == name {
+			return &x.keys[i]
+		}
+	}
+	x.keys = append(x.keys, headerKeys{name: name, byValue: make(map[string][]int32)})
+	return &x.keys[len(x.keys)-1]
+}
+
+// First the first route of routes, in order, accepted by match. Only the scanned routes and the ones indexed
+// under a value of h are given to match, the others can not match h. routes must be the list x was built from.
+func (x *HeaderIndex) First(routes []HeaderRoute, h stdHttp.Header, match func(*HeaderRoute) bool) *HeaderRoute {
+	best := len(routes)
+	// the first route of positions accepted by match, when it comes before best
+	first := func(positions []int32) {
+		for _, p := range positions {
+			if int(p) >= best {
+				return
+			}
+			if match(&routes[p]) {
+				best = int(p)
+				return
+			}
+		}
+	}
+	first(x.scan)
+	for i := range x.keys {
+		for _, v := range h[x.keys[i].name] {
+			first(x.keys[i].byValue[v])
+		}
+	}
+	if best == len(routes) {
+		return nil
+	}
+	return &routes[best]
+}
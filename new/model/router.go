@@ -19,7 +19,9 @@ package model
 
 import (
 	stdHttp "net/http"
+	"reflect"
 	"regexp"
+	"slices"
 	"strings"
 )
 
@@ -38,37 +40,143 @@ type (
 		ID    string      `yaml:"id" json:"id" mapstructure:"id"`
 		Match RouterMatch `yaml:"match" json:"match" mapstructure:"match"`
 		Route RouteAction `yaml:"route" json:"route" mapstructure:"route"`
+		// Priority orders routes competing for the same path, higher first, then in insertion order
+		Priority int `yaml:"priority,omitempty" json:"priority,omitempty" mapstructure:"priority"`
 	}
 
 	// RouterMatch
 	RouterMatch struct {
 		Prefix string `yaml:"prefix" json:"prefix" mapstructure:"prefix"`
 		Path   string `yaml:"path" json:"path" mapstructure:"path"`
-		// Regex   string          `yaml:"regex" json:"regex" mapstructure:"regex"` TODO: next version
+		// Regex must match the whole path. Only one of Prefix, Path and Regex can be set,
+		// a route setting several is reported by the validation and never served
+		Regex   string          `yaml:"regex,omitempty" json:"regex,omitempty" mapstructure:"regex"`
 		Methods []string        `yaml:"methods" json:"methods" mapstructure:"methods"`
 		Headers []HeaderMatcher `yaml:"headers,omitempty" json:"headers,omitempty" mapstructure:"headers"`
-		// pathRE  *regexp.Regexp
+		// QueryParams are evaluated after the path match, all of them must match
+		QueryParams []QueryParamMatcher `yaml:"query_params,omitempty" json:"query_params,omitempty" mapstructure:"query_params"`
+		// Cookies are evaluated like QueryParams, all of them must match
+		Cookies []CookieMatcher `yaml:"cookies,omitempty" json:"cookies,omitempty" mapstructure:"cookies"`
 	}
 
 	// RouteAction match route should do
 	RouteAction struct {
 		Cluster                     string `yaml:"cluster" json:"cluster" mapstructure:"cluster"`
 		ClusterNotFoundResponseCode int    `yaml:"cluster_not_found_response_code" json:"cluster_not_found_response_code" mapstructure:"cluster_not_found_response_code"`
+		// WeightedClusters split the traffic between clusters, the picked one is returned in Cluster at route time
+		WeightedClusters *WeightedClusters `yaml:"weighted_clusters,omitempty" json:"weighted_clusters,omitempty" mapstructure:"weighted_clusters"`
+		// Redirect answers the request with a redirect, no cluster is contacted
+		Redirect *RedirectAction `yaml:"redirect,omitempty" json:"redirect,omitempty" mapstructure:"redirect"`
+		// DirectResponse answers the request with a fixed response, no cluster is contacted
+		DirectResponse *DirectResponseAction `yaml:"direct_response,omitempty" json:"direct_response,omitempty" mapstructure:"direct_response"`
+		// PrefixRewrite replaces the matched Prefix of the path forwarded upstream, or the whole path of a Path / Regex route
+		PrefixRewrite string `yaml:"prefix_rewrite,omitempty" json:"prefix_rewrite,omitempty" mapstructure:"prefix_rewrite"`
+		// RegexRewrite rewrites the path forwarded upstream
+		RegexRewrite *RegexRewrite `yaml:"regex_rewrite,omitempty" json:"regex_rewrite,omitempty" mapstructure:"regex_rewrite"`
+	}
+
+	// RegexRewrite replaces every match of Pattern in the path by Substitution.
+	// Substitution may refer to the capture groups of Pattern ($1, ${name}) and to the path variables of the route ({id}).
+	RegexRewrite struct {
+		Pattern      string `yaml:"pattern" json:"pattern" mapstructure:"pattern"`
+		Substitution string `yaml:"substitution" json:"substitution" mapstructure:"substitution"`
+	}
+
+	// RedirectAction the parts of the request URL to replace in the Location, empty parts are kept.
+	// ResponseCode is 301, 302, 303, 307 or 308, 301 when not set.
+	RedirectAction struct {
+		Scheme       string `yaml:"scheme,omitempty" json:"scheme,omitempty" mapstructure:"scheme"`
+		Host         string `yaml:"host,omitempty" json:"host,omitempty" mapstructure:"host"`
+		Path         string `yaml:"path,omitempty" json:"path,omitempty" mapstructure:"path"`
+		StripQuery   bool   `yaml:"strip_query,omitempty" json:"strip_query,omitempty" mapstructure:"strip_query"`
+		ResponseCode int    `yaml:"response_code,omitempty" json:"response_code,omitempty" mapstructure:"response_code"`
+	}
+
+	// DirectResponseAction a fixed response, Status is 200 when not set
+	DirectResponseAction struct {
+		Status  int               `yaml:"status,omitempty" json:"status,omitempty" mapstructure:"status"`
+		Body    string            `yaml:"body,omitempty" json:"body,omitempty" mapstructure:"body"`
+		Headers map[string]string `yaml:"headers,omitempty" json:"headers,omitempty" mapstructure:"headers"`
+	}
+
+	// WeightedClusters each cluster gets Weight / sum of weights of the requests.
+	// With HashHeader or HashCookie set, requests carrying the same value go to the same cluster.
+	WeightedClusters struct {
+		Clusters    []WeightedCluster `yaml:"clusters" json:"clusters" mapstructure:"clusters"`
+		TotalWeight uint32            `yaml:"total_weight,omitempty" json:"total_weight,omitempty" mapstructure:"total_weight"`
+		HashHeader  string            `yaml:"hash_header,omitempty" json:"hash_header,omitempty" mapstructure:"hash_header"`
+		HashCookie  string            `yaml:"hash_cookie,omitempty" json:"hash_cookie,omitempty" mapstructure:"hash_cookie"`
+	}
+
+	// WeightedCluster a cluster of WeightedClusters
+	WeightedCluster struct {
+		Name   string `yaml:"name" json:"name" mapstructure:"name"`
+		Weight uint32 `yaml:"weight" json:"weight" mapstructure:"weight"`
 	}
 
 	// RouteConfiguration
 	RouteConfiguration struct {
-		RouteTrie trie.Trie `yaml:"-" json:"-" mapstructure:"-"`
-		Routes    []*Router `yaml:"routes" json:"routes" mapstructure:"routes"`
-		Dynamic   bool      `yaml:"dynamic" json:"dynamic" mapstructure:"dynamic"`
+		RouteTrie trie.Trie[RouteAction] `yaml:"-" json:"-" mapstructure:"-"`
+		Routes    []*Router              `yaml:"routes" json:"routes" mapstructure:"routes"`
+		// VirtualHosts group routes by request host, Routes serve the hosts no virtual host claims
+		VirtualHosts []*VirtualHost `yaml:"virtual_hosts,omitempty" json:"virtual_hosts,omitempty" mapstructure:"virtual_hosts"`
+		Dynamic      bool           `yaml:"dynamic" json:"dynamic" mapstructure:"dynamic"`
+	}
+
+	// VirtualHost routes served for a set of domains, Name must be unique and not empty.
+	// A domain is an exact host (api.example.com), a wildcard suffix (*.example.com) or * for any other host,
+	// the port of the request host is ignored.
+	VirtualHost struct {
+		Name    string    `yaml:"name" json:"name" mapstructure:"name"`
+		Domains []string  `yaml:"domains" json:"domains" mapstructure:"domains"`
+		Routes  []*Router `yaml:"routes" json:"routes" mapstructure:"routes"`
 	}
 
-	// HeaderMatcher include Name header key, Values header value, Regex regex value
+	// HeaderMatcher include Name header key, Values header value, Regex regex value.
+	// At most one of Values, Present, Absent, Prefix, Suffix, Contains and Range is set, without any of them
+	// the header only needs a non-empty value. A header given several times matches when one of its values matches,
+	// an empty value never matches a value condition. Invert negates the whole condition, so a missing header
+	// matches an inverted value condition.
 	HeaderMatcher struct {
+		Name     string       `yaml:"name" json:"name" mapstructure:"name"`
+		Values   []string     `yaml:"values" json:"values" mapstructure:"values"`
+		Regex    bool         `yaml:"regex" json:"regex" mapstructure:"regex"`
+		Present  bool         `yaml:"present,omitempty" json:"present,omitempty" mapstructure:"present"`
+		Absent   bool         `yaml:"absent,omitempty" json:"absent,omitempty" mapstructure:"absent"`
+		Prefix   string       `yaml:"prefix,omitempty" json:"prefix,omitempty" mapstructure:"prefix"`
+		Suffix   string       `yaml:"suffix,omitempty" json:"suffix,omitempty" mapstructure:"suffix"`
+		Contains string       `yaml:"contains,omitempty" json:"contains,omitempty" mapstructure:"contains"`
+		Range    *HeaderRange `yaml:"range,omitempty" json:"range,omitempty" mapstructure:"range"`
+		// IgnoreCase compare Values, Prefix, Suffix and Contains case-insensitively
+		IgnoreCase bool `yaml:"ignore_case,omitempty" json:"ignore_case,omitempty" mapstructure:"ignore_case"`
+		Invert     bool `yaml:"invert,omitempty" json:"invert,omitempty" mapstructure:"invert"`
+		valueRE    *regexp.Regexp
+	}
+
+	// HeaderRange the header value is a base 10 integer in [Start, End)
+	HeaderRange struct {
+		Start int64 `yaml:"start" json:"start" mapstructure:"start"`
+		End   int64 `yaml:"end" json:"end" mapstructure:"end"`
+	}
+
+	// QueryParamMatcher include Name query parameter key, Values parameter value, Regex regex value.
+	// Present only requires the parameter, Absent requires it to be missing,
+	// a parameter given several times matches when one of its values matches.
+	QueryParamMatcher struct {
+		Name    string   `yaml:"name" json:"name" mapstructure:"name"`
+		Values  []string `yaml:"values,omitempty" json:"values,omitempty" mapstructure:"values"`
+		Regex   bool     `yaml:"regex,omitempty" json:"regex,omitempty" mapstructure:"regex"`
+		Present bool     `yaml:"present,omitempty" json:"present,omitempty" mapstructure:"present"`
+		Absent  bool     `yaml:"absent,omitempty" json:"absent,omitempty" mapstructure:"absent"`
+	}
+
+	// CookieMatcher include Name cookie name, Values cookie value, Regex regex value.
+	// Present only requires the cookie, only the first cookie of a name is matched, as req.Cookie returns it.
+	CookieMatcher struct {
 		Name    string   `yaml:"name" json:"name" mapstructure:"name"`
-		Values  []string `yaml:"values" json:"values" mapstructure:"values"`
-		Regex   bool     `yaml:"regex" json:"regex" mapstructure:"regex"`
-		valueRE *regexp.Regexp
+		Values  []string `yaml:"values,omitempty" json:"values,omitempty" mapstructure:"values"`
+		Regex   bool     `yaml:"regex,omitempty" json:"regex,omitempty" mapstructure:"regex"`
+		Present bool     `yaml:"present,omitempty" json:"present,omitempty" mapstructure:"present"`
 	}
 )
 
@@ -81,14 +189,10 @@ func (rc *RouteConfiguration) RouteByPathAndMethod(path, method string) (*RouteA
 		return nil, errors.Errorf("router configuration is empty")
 	}
 
-	node, _, _ := rc.RouteTrie.Match(stringutil.GetTrieKey(method, path))
-	if node == nil {
+	ret, _, ok := rc.RouteTrie.Match(stringutil.GetTrieKey(method, path))
+	if !ok {
 		return nil, errors.Errorf("route failed for %s, no rules matched.", stringutil.GetTrieKey(method, path))
 	}
-	if node.GetBizInfo() == nil {
-		return nil, errors.Errorf("action is nil. please check your configuration.")
-	}
-	ret := (node.GetBizInfo()).(RouteAction)
 
 	return &ret, nil
 }
@@ -97,39 +201,24 @@ func (rc *RouteConfiguration) Route(req *stdHttp.Request) (*RouteAction, error)
 	return rc.RouteByPathAndMethod(req.URL.Path, req.Method)
 }
 
-// MatchHeader used when there's only headers to match
+// MatchHeader used when there's only headers to match, every header condition must hold as for a snapshot route
 func (rm *RouterMatch) MatchHeader(req *stdHttp.Request) bool {
-	if len(rm.Methods) > 0 {
-		for _, method := range rm.Methods {
-			if method == req.Method {
-				goto HEADER
-			}
-		}
+	if len(rm.Methods) > 0 && !slices.Contains(rm.Methods, req.Method) {
 		return false
 	}
-HEADER:
-	for _, header := range rm.Headers {
-		if val := req.Header.Get(header.Name); len(val) > 0 {
-			if header.MatchValues(val) {
-				return true
-			}
+	chs := compileHeaders(rm.Headers)
+	for i := range chs {
+		if !chs[i].Match(req.Header[chs[i].Name]) {
+			return false
 		}
 	}
-	return false
+	return true
 }
 
-// MatchValues match values in header, including regex type
+// MatchValues the header set to dst satisfies hm, including regex type and the other operators
 func (hm *HeaderMatcher) MatchValues(dst string) bool {
-	if hm.Regex && hm.valueRE != nil {
-		return hm.valueRE.MatchString(dst)
-	}
-
-	for _, src := range hm.Values {
-		if src == dst {
-			return true
-		}
-	}
-	return false
+	chs := compileHeaders([]HeaderMatcher{*hm})
+	return chs[0].Match([]string{dst})
 }
 
 // SetValueRegex compile the regex, disable regex if it failed
@@ -148,9 +237,45 @@ func (r *Router) String() string {
 	builder.WriteString("[" + strings.Join(r.Match.Methods, ",") + "] ")
 	if r.Match.Prefix != "" {
 		builder.WriteString("prefix " + r.Match.Prefix)
+	} else if r.Match.Path == "" && r.Match.Regex != "" {
+		builder.WriteString("regex " + r.Match.Regex)
 	} else {
 		builder.WriteString("path " + r.Match.Path)
 	}
-	builder.WriteString(" to cluster " + r.Route.Cluster)
+	switch r.Route.Kind() {
+	case ActionRedirect:
+		builder.WriteString(" redirect")
+	case ActionDirectResponse:
+		builder.WriteString(" direct response")
+	default:
+		builder.WriteString(" to cluster " + r.Route.Cluster)
+	}
 	return builder.String()
 }
+
+// SameMatch r and o match the same requests with the same priority
+func (r *Router) SameMatch(o *Router) bool {
+	m, om := &r.Match, &o.Match
+	return r.Priority == o.Priority &&
+		m.Prefix == om.Prefix && m.Path == om.Path && m.Regex == om.Regex &&
+		slices.Equal(m.Methods, om.Methods) &&
+		slices.EqualFunc(m.Headers, om.Headers, func(a, b HeaderMatcher) bool {
+			return a.Name == b.Name && a.Regex == b.Regex && slices.Equal(a.Values, b.Values) &&
+				a.Present == b.Present && a.Absent == b.Absent &&
+				a.Prefix == b.Prefix && a.Suffix == b.Suffix && a.Contains == b.Contains &&
+				(a.Range == nil) == (b.Range == nil) && (a.Range == nil || *a.Range == *b.Range) &&
+				a.IgnoreCase == b.IgnoreCase && a.Invert == b.Invert
+		}) &&
+		slices.EqualFunc(m.QueryParams, om.QueryParams, func(a, b QueryParamMatcher) bool {
+			return a.Name == b.Name && a.Regex == b.Regex && a.Present == b.Present && a.Absent == b.Absent &&
+				slices.Equal(a.Values, b.Values)
+		}) &&
+		slices.EqualFunc(m.Cookies, om.Cookies, func(a, b CookieMatcher) bool {
+			return a.Name == b.Name && a.Regex == b.Regex && a.Present == b.Present && slices.Equal(a.Values, b.Values)
+		})
+}
+
+// SameAction r and o do the same with the requests they match
+func (r *Router) SameAction(o *Router) bool {
+	return reflect.DeepEqual(r.Route, o.Route)
+}
@@ -1,11 +1,21 @@
 package model
 
 import (
+	"cmp"
+	stdHttp "net/http"
+	"net/textproto"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 )
 
+import (
+	"github.com/pkg/errors"
+)
+
 import (
 	"github.com/alanxtl/pixiu-router-update/new/trie"
 	util "github.com/alanxtl/pixiu-router-update/utils"
@@ -13,25 +23,230 @@ import (
 
 // RouteSnapshot Read-only snapshot for routing
 type RouteSnapshot struct {
-	// multi-trie for each method, built once and read-only
-	MethodTries map[string]*trie.Trie
+	// set by the publisher, increases with every published snapshot
+	Version uint64
+
+	// route table of each virtual host by name, DefaultHost holds the routes outside of any virtual host
+	Hosts map[string]*RouteTable
+
+	// request host -> virtual host name
+	Domains DomainIndex
+}
+
+// RouteTable the routes of one virtual host
+type RouteTable struct {
+	// immutable multi-trie for each method, snapshot versions share the unchanged nodes
+	MethodTries map[string]*trie.ImmutableTrie[*TrieLeaf]
+	// path-compressed layout of MethodTries that requests are matched against.
+	// The tries are kept as the base the next publish edits, and the radix points at their nodes to reuse
+	// the unchanged subtrees, so dropping them would free little: the radix adds about 90 bytes per route
+	// to the 115 of the trie (BenchmarkSnapshot_TrieVsRadix/heap-100k).
+	MethodRadix map[string]*trie.Radix[*TrieLeaf]
 
 	// precompiled regex for header-only routes
 	HeaderOnly []HeaderRoute
+	// HeaderOnly by header value, nil when HeaderOnly is empty
+	HeaderIndex *HeaderIndex
+
+	// full path regex routes, in config order.
+	// precedence of a request: HeaderOnly first, then MethodTries, then Regex.
+	Regex []RegexRoute
+}
+
+// Table the route table serving the request host, nil if its virtual host has no routes
+func (s *RouteSnapshot) Table(host string) *RouteTable {
+	return s.Hosts[s.Domains.Resolve(host)]
+}
+
+// IsEmpty the table holds no route
+func (t *RouteTable) IsEmpty() bool {
+	for _, it := range t.MethodTries {
+		if !it.IsEmpty() {
+			return false
+		}
+	}
+	return len(t.HeaderOnly) == 0 && len(t.Regex) == 0
 }
 
 type HeaderRoute struct {
+	RouteEntry
+	Methods []string
+	Headers []CompiledHeader
+	Query   []CompiledQueryParam
+	Cookies []CompiledCookie
+	seq     uint64 // insertion order of the route
+}
+
+type RegexRoute struct {
+	RouteEntry
 	Methods []string
+	Path    *regexp.Regexp // anchored, matches the whole path
 	Headers []CompiledHeader
+	Query   []CompiledQueryParam
+	Cookies []CompiledCookie
+	groups  []int  // submatch index of each ParamNames entry
+	seq     uint64 // insertion order of the route
+}
+
+// TrieLeaf the routes sharing one trie node, stored as the bizInfo of the node.
+// Candidates are evaluated in order and the first one whose headers, query parameters and cookies match wins:
+// higher Priority first, then routes with such conditions before routes without, then in insertion order.
+type TrieLeaf struct {
+	Candidates []TrieCandidate
+}
+
+// TrieCandidate a path / prefix route and its header, query parameter and cookie conditions
+type TrieCandidate struct {
+	*RouteEntry
+	Headers    []CompiledHeader
+	Query      []CompiledQueryParam
+	Cookies    []CompiledCookie
+	conditions string // see conditionKey
+}
+
+// Conditional the candidate has conditions beyond the path
+func (c *TrieCandidate) Conditional() bool {
+	return len(c.Headers) > 0 || len(c.Query) > 0 || len(c.Cookies) > 0
+}
+
+// RouteEntry the route a snapshot leaf points to
+type RouteEntry struct {
+	ID         string
+	Pattern    string   // Path, Prefix or Regex of the route, empty for header-only routes
+	ParamNames []string // names of the path variables in Pattern, in path order
+	Action     RouteAction
+	Split      *ClusterSplit // compiled Action.WeightedClusters, nil without
+	Priority   int
+	actions    []RouteAction // Action with each cluster of Split picked, in Split order
+	isPrefix   bool          // Pattern is a Prefix
+}
+
+// MatchResult the route matched by a request
+type MatchResult struct {
+	RouteID string
+	Pattern string
+	Params  map[string]string // path variable name -> value, nil if the route has none
 	Action  RouteAction
+	Path    string // path to forward upstream, the request path rewritten by PrefixRewrite / RegexRewrite
 }
 
+// HeaderMatchKind how a CompiledHeader tests its header
+type HeaderMatchKind uint8
+
+const (
+	HeaderNonEmpty HeaderMatchKind = iota // a non-empty value
+	HeaderPresent                         // the header is set
+	HeaderAbsent                          // the header is not set
+	HeaderExact                           // a value in Values
+	HeaderRegex                           // a value matching Regex
+	HeaderPrefix                          // a value starting with Pattern
+	HeaderSuffix                          // a value ending with Pattern
+	HeaderContains                        // a value containing Pattern
+	HeaderInRange                         // a base 10 integer value in [Start, End)
+)
+
+// CompiledHeader a header condition, Name is in canonical form
 type CompiledHeader struct {
+	Name       string
+	Kind       HeaderMatchKind
+	Regex      *regexp.Regexp
+	Values     []string
+	Pattern    string // Prefix, Suffix or Contains
+	Start, End int64
+	IgnoreCase bool
+	Invert     bool
+}
+
+// Match the values of the header, nil when it is not set, satisfy ch, Invert included
+func (ch *CompiledHeader) Match(values []string) bool {
+	return ch.match(values) != ch.Invert
+}
+
+// match the condition of ch before Invert
+func (ch *CompiledHeader) match(values []string) bool {
+	switch ch.Kind {
+	case HeaderPresent:
+		return len(values) > 0
+	case HeaderAbsent:
+		return len(values) == 0
+	}
+	for _, v := range values {
+		if v != "" && matchHeaderValue(ch, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHeaderValue(ch *CompiledHeader, v string) bool {
+	switch ch.Kind {
+	case HeaderExact:
+		if ch.IgnoreCase {
+			return slices.ContainsFunc(ch.Values, func(s string) bool { return strings.EqualFold(s, v) })
+		}
+		return slices.Contains(ch.Values, v)
+	case HeaderRegex:
+		return ch.Regex.MatchString(v)
+	case HeaderPrefix:
+		if ch.IgnoreCase {
+			return len(v) >= len(ch.Pattern) && strings.EqualFold(v[:len(ch.Pattern)], ch.Pattern)
+		}
+		return strings.HasPrefix(v, ch.Pattern)
+	case HeaderSuffix:
+		if ch.IgnoreCase {
+			return len(v) >= len(ch.Pattern) && strings.EqualFold(v[len(v)-len(ch.Pattern):], ch.Pattern)
+		}
+		return strings.HasSuffix(v, ch.Pattern)
+	case HeaderContains:
+		if ch.IgnoreCase {
+			for i := 0; i+len(ch.Pattern) <= len(v); i++ {
+				if strings.EqualFold(v[i:i+len(ch.Pattern)], ch.Pattern) {
+					return true
+				}
+			}
+			return false
+		}
+		return strings.Contains(v, ch.Pattern)
+	case HeaderInRange:
+		n, ok := parseHeaderInt(v)
+		return ok && n >= ch.Start && n < ch.End
+	}
+	// HeaderNonEmpty
+	return true
+}
+
+// parseHeaderInt a base 10 integer, other values are rejected before ParseInt allocates an error for them
+func parseHeaderInt(v string) (int64, bool) {
+	digits := strings.TrimLeft(v, "+-")
+	if digits == "" || len(v)-len(digits) > 1 || strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }) >= 0 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	return n, err == nil
+}
+
+// CompiledQueryParam a query parameter condition, only presence is checked when Regex and Values are empty
+type CompiledQueryParam struct {
+	Name   string
+	Regex  *regexp.Regexp
+	Values []string
+	Absent bool // the parameter must not be in the query
+}
+
+// CompiledCookie a cookie condition, only presence is checked when Regex and Values are empty
+type CompiledCookie struct {
 	Name   string
 	Regex  *regexp.Regexp
 	Values []string
 }
 
+// TrieKey identifies one entry in the method tries of a RouteSnapshot
+type TrieKey struct {
+	Host   string // virtual host name
+	Method string
+	Key    string // method qualified key, see GetTrieKeyWithPrefix
+}
+
 // SnapshotHolder holds current active snapshot
 type SnapshotHolder struct {
 	ptr atomic.Pointer[RouteSnapshot]
@@ -52,21 +267,8 @@ func MethodAllowed(methods []string, m string) bool {
 	return false
 }
 
-var regexCache sync.Map // map[string]*regexp.Regexp
-
 func getCachedRegexp(pat string) *regexp.Regexp {
-	if v, ok := regexCache.Load(pat); ok {
-		return v.(*regexp.Regexp)
-	}
-	// Compile 失败就返回 nil（调用方会忽略该正则）
-	re, err := regexp.Compile(pat)
-	if err != nil {
-		return nil
-	}
-	if v, ok := regexCache.LoadOrStore(pat, re); ok {
-		return v.(*regexp.Regexp)
-	}
-	return re
+	return util.GetCachedRegexp(pat)
 }
 
 // -------- builder pools：构建期临时切片/对象的池化 --------
@@ -77,92 +279,457 @@ var compiledHeaderSlicePool = sync.Pool{
 	},
 }
 
+// NewRouteEntry the entry of r stored in the snapshot, fails with the Fatal ValidationErrors of a route that can not be compiled
+func NewRouteEntry(r *Router) (*RouteEntry, error) {
+	if errs := ValidateRouter(r).Fatal(); len(errs) > 0 {
+		return nil, errs
+	}
+	e := &RouteEntry{ID: r.ID, Pattern: r.Match.Path, Action: r.Route, Priority: r.Priority}
+	switch KindOf(r) {
+	case KindTrie:
+		if r.Match.Prefix != "" {
+			e.Pattern, e.isPrefix = r.Match.Prefix, true
+		}
+		for _, seg := range util.Split(e.Pattern) {
+			if util.IsPathVariableOrWildcard(seg) {
+				e.ParamNames = append(e.ParamNames, util.VariableName(seg))
+			}
+		}
+	case KindRegex:
+		e.Pattern = r.Match.Regex
+	}
+	if wc := r.Route.WeightedClusters; wc != nil {
+		split, err := NewClusterSplit(wc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "route %s", r.ID)
+		}
+		e.Split = split
+		e.actions = make([]RouteAction, len(split.names))
+		for i, name := range split.names {
+			e.actions[i] = e.Action
+			e.actions[i].Cluster = name
+		}
+	}
+	return e, nil
+}
+
+// Resolve the action for req, with the weighted cluster picked into Cluster. req may be nil.
+func (e *RouteEntry) Resolve(src WeightSource, req *stdHttp.Request) RouteAction {
+	act := e.Action
+	if e.Split != nil {
+		act.Cluster = e.Split.Pick(src, req)
+	}
+	return act
+}
+
+// ResolveShared like Resolve without a copy: the action belongs to the snapshot and must not be modified. req may be nil.
+func (e *RouteEntry) ResolveShared(src WeightSource, req *stdHttp.Request) *RouteAction {
+	if e.Split == nil {
+		return &e.Action
+	}
+	return &e.actions[e.Split.pick(src, req)]
+}
+
+// NewTrieCandidate the candidate of r in a TrieLeaf
+func NewTrieCandidate(r *Router) (TrieCandidate, error) {
+	e, err := NewRouteEntry(r)
+	if err != nil {
+		return TrieCandidate{}, err
+	}
+	c := TrieCandidate{
+		RouteEntry: e,
+		Headers:    compileHeaders(r.Match.Headers),
+		Query:      compileQueryParams(r.Match.QueryParams),
+		Cookies:    compileCookies(r.Match.Cookies),
+	}
+	c.conditions = conditionKey(&c)
+	return c, nil
+}
+
+// NewTrieLeaf order the candidates of one trie node, cands are given in insertion order
+func NewTrieLeaf(cands []TrieCandidate) *TrieLeaf {
+	cands = slices.Clone(cands)
+	slices.SortStableFunc(cands, func(a, b TrieCandidate) int {
+		if a.Priority != b.Priority {
+			return cmp.Compare(b.Priority, a.Priority)
+		}
+		return boolRank(b.Conditional()) - boolRank(a.Conditional())
+	})
+	return &TrieLeaf{Candidates: cands}
+}
+
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Result build the MatchResult of the entry from the request path and its matched path variable values
+func (e *RouteEntry) Result(path string, values []string) *MatchResult {
+	res := &MatchResult{RouteID: e.ID, Pattern: e.Pattern, Action: e.Action}
+	if len(e.ParamNames) > 0 {
+		res.Params = make(map[string]string, len(e.ParamNames))
+		for i, v := range values {
+			if i < len(e.ParamNames) {
+				res.Params[e.ParamNames[i]] = v
+			}
+		}
+	}
+	prefix := ""
+	if e.isPrefix {
+		prefix = e.Pattern
+	}
+	res.Path = e.Action.rewritePath(path, prefix, res.Params)
+	return res
+}
+
+// Values the named groups of the regex matched by path, aligned with ParamNames
+func (rr *RegexRoute) Values(path string) []string {
+	if len(rr.groups) == 0 {
+		return nil
+	}
+	sub := rr.Path.FindStringSubmatch(path)
+	values := make([]string, len(rr.groups))
+	for i, g := range rr.groups {
+		values[i] = sub[g]
+	}
+	return values
+}
+
+// 默认方法集合：常量切片，避免每次分配
+var constMethods = []string{"GET", "POST", "PUT", "DELETE", "PATCH", "OPTIONS", "HEAD"}
+
+// RouteKind where a route lives in a RouteSnapshot
+type RouteKind int
+
+const (
+	KindTrie       RouteKind = iota // Path / Prefix, in MethodTries
+	KindHeaderOnly                  // only Headers / QueryParams / Cookies, in HeaderOnly
+	KindRegex                       // Regex without Path / Prefix, in Regex
+)
+
+// KindOf where r lives in a snapshot, a route with Regex and Path / Prefix is a trie route failing validation
+func KindOf(r *Router) RouteKind {
+	switch {
+	case r.Match.Path != "" || r.Match.Prefix != "":
+		return KindTrie
+	case r.Match.Regex != "":
+		return KindRegex
+	case len(r.Match.Headers) > 0 || len(r.Match.QueryParams) > 0 || len(r.Match.Cookies) > 0:
+		return KindHeaderOnly
+	}
+	return KindTrie
+}
+
+// IsHeaderOnly route with Headers, QueryParams or Cookies, without Path / Prefix / Regex
+func IsHeaderOnly(r *Router) bool {
+	return KindOf(r) == KindHeaderOnly
+}
+
+// RouteMethods methods of the route, all methods if none is configured
+func RouteMethods(r *Router) []string {
+	if len(r.Match.Methods) == 0 {
+		return constMethods
+	}
+	return r.Match.Methods
+}
+
+// TrieKeys keys the route occupies in the method tries, nil for header-only and regex routes.
+// Variable names are dropped from the keys, routes reaching the same trie node get the same key.
+func TrieKeys(host string, r *Router) []TrieKey {
+	if KindOf(r) != KindTrie {
+		return nil
+	}
+	isPrefix := r.Match.Prefix != ""
+	methods := RouteMethods(r)
+	keys := make([]TrieKey, 0, len(methods))
+	for _, m := range methods {
+		key := canonicalKey(util.GetTrieKeyWithPrefix(m, r.Match.Path, r.Match.Prefix, isPrefix))
+		keys = append(keys, TrieKey{Host: host, Method: m, Key: key})
+	}
+	return keys
+}
+
+// canonicalKey rename every path variable of key to _, keeping its constraint: /a/:id and /a/* give /a/:_, /a/:id(\d+) gives /a/:_(\d+)
+func canonicalKey(key string) string {
+	if !strings.ContainsAny(key, ":*") {
+		return key
+	}
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		if i == 0 || !util.IsPathVariableOrWildcard(p) {
+			continue
+		}
+		if _, constraint := util.VariableConstraint(p); constraint != "" {
+			parts[i] = ":_(" + constraint + ")"
+		} else {
+			parts[i] = ":_"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// ToSnapshot build the snapshot of cfg, a virtual host without name or with a name already used is skipped
 func ToSnapshot(cfg *RouteConfiguration) *RouteSnapshot {
+	s, _ := BuildSnapshot(cfg)
+	return s
+}
+
+// BuildSnapshot like ToSnapshot, also reports the routes shadowed by another route of the same trie key
+func BuildSnapshot(cfg *RouteConfiguration) (*RouteSnapshot, []Conflict) {
+	s := &RouteSnapshot{
+		Hosts:   make(map[string]*RouteTable, 1+len(cfg.VirtualHosts)),
+		Domains: NewDomainIndex(cfg.VirtualHosts),
+	}
+	var conflicts []Conflict
+	var seq uint64 // insertion order across virtual hosts, routes are counted in config order
+	s.Hosts[DefaultHost] = toRouteTable(DefaultHost, cfg.Routes, &seq, &conflicts)
+	for _, vh := range cfg.VirtualHosts {
+		if vh == nil || vh.Name == DefaultHost || s.Hosts[vh.Name] != nil {
+			continue
+		}
+		s.Hosts[vh.Name] = toRouteTable(vh.Name, vh.Routes, &seq, &conflicts)
+	}
+	SortConflicts(conflicts)
+	return s, conflicts
+}
+
+// toRouteTable build the route table of the virtual host named host, conflicts of its trie keys are appended to conflicts.
+// The routes get their insertion order from seq, which is advanced past them.
+func toRouteTable(host string, routes []*Router, seq *uint64, conflicts *[]Conflict) *RouteTable {
 	// -------------- 预扫描：估算 header-only 数量，便于预分配 --------------
 	headerOnlyCount := 0
-	for _, r := range cfg.Routes {
-		if r.Match.Path == "" && r.Match.Prefix == "" && len(r.Match.Headers) > 0 {
+	for _, r := range routes {
+		if IsHeaderOnly(r) {
 			headerOnlyCount++
 		}
 	}
 
-	s := &RouteSnapshot{
-		MethodTries: make(map[string]*trie.Trie, 8),
+	s := &RouteTable{
+		MethodTries: make(map[string]*trie.ImmutableTrie[*TrieLeaf], 8),
+		MethodRadix: make(map[string]*trie.Radix[*TrieLeaf], 8),
 	}
 	if headerOnlyCount > 0 {
 		s.HeaderOnly = make([]HeaderRoute, 0, headerOnlyCount)
 	}
 
-	// 默认方法集合：常量切片，避免每次分配
-	constMethods := []string{"GET", "POST", "PUT", "DELETE", "PATCH", "OPTIONS", "HEAD"}
-
-	// 局部 get-or-create，减少 map 查询/分配噪音
-	getTrie := func(m string) *trie.Trie {
-		if t := s.MethodTries[m]; t != nil {
+	// 局部 get-or-create，减少 map 查询/分配噪音；构建完成后再冻结为不可变版本
+	tries := make(map[string]*trie.Trie[*TrieLeaf], 8)
+	getTrie := func(m string) *trie.Trie[*TrieLeaf] {
+		if t := tries[m]; t != nil {
 			return t
 		}
-		nt := trie.NewTrie()
-		s.MethodTries[m] = &nt
+		nt := trie.NewTrie[*TrieLeaf]()
+		tries[m] = &nt
 		return &nt
 	}
+	// candidates of each trie key in config order, keys in order of first use
+	leaves := make(map[TrieKey][]TrieCandidate)
+	var keys []TrieKey
 
-	for _, r := range cfg.Routes {
+	for _, r := range routes {
+		order := *seq
+		*seq++
+		switch KindOf(r) {
 		// ============= A) header-only：with Headers, without Path / Prefix =============
-		if r.Match.Path == "" && r.Match.Prefix == "" && len(r.Match.Headers) > 0 {
-			hr := HeaderRoute{
-				Methods: r.Match.Methods,
-				Action:  r.Route,
+		case KindHeaderOnly:
+			if hr, ok := compileHeaderRoute(r, order); ok {
+				s.HeaderOnly = append(s.HeaderOnly, hr)
+			}
+			continue
+		// ============= C) regex：whole path regex, without Path / Prefix =============
+		case KindRegex:
+			if rr, ok := compileRegexRoute(r, order); ok {
+				s.Regex = append(s.Regex, rr)
+			}
+			continue
+		}
+
+		// ================= B) Trie：精确/前缀/变量 路由，可带 Headers =================
+		c, err := NewTrieCandidate(r)
+		if err != nil {
+			continue
+		}
+		for _, k := range TrieKeys(host, r) {
+			if _, ok := leaves[k]; !ok {
+				keys = append(keys, k)
 			}
+			leaves[k] = append(leaves[k], c)
+		}
+	}
+	for _, k := range keys {
+		leaf := NewTrieLeaf(leaves[k])
+		if c, ok := leaf.Conflict(k); ok {
+			*conflicts = append(*conflicts, c)
+		}
+		_, _ = getTrie(k.Method).Put(k.Key, leaf)
+	}
+	for m, t := range tries {
+		it := t.Freeze()
+		s.MethodTries[m] = &it
+		s.MethodRadix[m] = trie.CompileRadix(&it, nil)
+	}
+	sortByPriority(s.HeaderOnly)
+	sortByPriority(s.Regex)
+	if len(s.HeaderOnly) > 0 {
+		s.HeaderIndex = NewHeaderIndex(s.HeaderOnly)
+	}
+	return s
+}
 
-			// 用池获取一个临时切片来承接 headers，减少构建期垃圾
-			chPtr := compiledHeaderSlicePool.Get().(*[]CompiledHeader)
-			ch := (*chPtr)[:0] // reset
-
-			for _, h := range r.Match.Headers {
-				c := CompiledHeader{Name: h.Name}
-				if h.Regex {
-					// 1) 模型已提供编译好的正则（若有）→ 直接用
-					if h.valueRE != nil {
-						c.Regex = h.valueRE
-					} else if len(h.Values) > 0 && h.Values[0] != "" {
-						// 2) 否则走全局缓存/编译（跨快照复用）
-						if re := getCachedRegexp(h.Values[0]); re != nil {
-							c.Regex = re
-						}
-					}
-				} else {
-					// not regex → 枚举值拷贝
-					if len(h.Values) > 0 {
-						// 注意：这里直接 append 值字符串（不可变），无需复制底层数组
-						c.Values = append(c.Values, h.Values...)
-					}
-				}
-				ch = append(ch, c)
+// compileRegexRoute compile the path regex and the headers of a regex route inserted at seq, false if the regex or the action is invalid
+func compileRegexRoute(r *Router, seq uint64) (RegexRoute, bool) {
+	re := util.GetCachedAnchoredRegexp(r.Match.Regex)
+	if re == nil {
+		return RegexRoute{}, false
+	}
+	e, err := NewRouteEntry(r)
+	if err != nil {
+		return RegexRoute{}, false
+	}
+	rr := RegexRoute{
+		RouteEntry: *e,
+		Methods:    r.Match.Methods,
+		Path:       re,
+		Headers:    compileHeaders(r.Match.Headers),
+		Query:      compileQueryParams(r.Match.QueryParams),
+		Cookies:    compileCookies(r.Match.Cookies),
+		seq:        seq,
+	}
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			rr.ParamNames = append(rr.ParamNames, name)
+			rr.groups = append(rr.groups, i)
+		}
+	}
+	return rr, true
+}
+
+// compileHeaderRoute compile the header, query parameter and cookie matchers of a header-only route inserted at seq, false if the action is invalid
+func compileHeaderRoute(r *Router, seq uint64) (HeaderRoute, bool) {
+	e, err := NewRouteEntry(r)
+	if err != nil {
+		return HeaderRoute{}, false
+	}
+	return HeaderRoute{
+		RouteEntry: *e,
+		Methods:    r.Match.Methods,
+		Headers:    compileHeaders(r.Match.Headers),
+		Query:      compileQueryParams(r.Match.QueryParams),
+		Cookies:    compileCookies(r.Match.Cookies),
+		seq:        seq,
+	}, true
+}
+
+// compileQueryParams compile query parameter matchers for the snapshot,
+// an invalid regex falls back to exact values like HeaderMatcher.SetValueRegex
+func compileQueryParams(params []QueryParamMatcher) []CompiledQueryParam {
+	if len(params) == 0 {
+		return nil
+	}
+	out := make([]CompiledQueryParam, 0, len(params))
+	for _, p := range params {
+		c := CompiledQueryParam{Name: p.Name, Absent: p.Absent}
+		switch {
+		case p.Absent || p.Present:
+		case p.Regex && len(p.Values) > 0:
+			if c.Regex = getCachedRegexp(p.Values[0]); c.Regex == nil {
+				c.Values = p.Values
+			}
+		default:
+			c.Values = p.Values
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// compileCookies compile cookie matchers for the snapshot, an invalid regex falls back to exact values
+func compileCookies(cookies []CookieMatcher) []CompiledCookie {
+	if len(cookies) == 0 {
+		return nil
+	}
+	out := make([]CompiledCookie, 0, len(cookies))
+	for _, c := range cookies {
+		cc := CompiledCookie{Name: c.Name}
+		switch {
+		case c.Present:
+		case c.Regex && len(c.Values) > 0:
+			if cc.Regex = getCachedRegexp(c.Values[0]); cc.Regex == nil {
+				cc.Values = c.Values
 			}
+		default:
+			cc.Values = c.Values
+		}
+		out = append(out, cc)
+	}
+	return out
+}
 
-			// 把临时切片的内容转移到快照（拥有期在快照）
-			hr.Headers = make([]CompiledHeader, len(ch))
-			copy(hr.Headers, ch)
+// compileHeaders compile header matchers for the snapshot
+func compileHeaders(headers []HeaderMatcher) []CompiledHeader {
+	if len(headers) == 0 {
+		return nil
+	}
 
-			// 归还临时切片到池（清空引用，避免持有快照数据）
-			*chPtr = (*chPtr)[:0]
-			compiledHeaderSlicePool.Put(chPtr)
+	// 用池获取一个临时切片来承接 headers，减少构建期垃圾
+	chPtr := compiledHeaderSlicePool.Get().(*[]CompiledHeader)
+	ch := (*chPtr)[:0] // reset
 
-			s.HeaderOnly = append(s.HeaderOnly, hr)
+	for _, h := range headers {
+		c := CompiledHeader{Name: textproto.CanonicalMIMEHeaderKey(h.Name), IgnoreCase: h.IgnoreCase, Invert: h.Invert}
+		switch {
+		case h.Present:
+			c.Kind = HeaderPresent
+		case h.Absent:
+			c.Kind = HeaderAbsent
+		case h.Prefix != "":
+			c.Kind, c.Pattern = HeaderPrefix, h.Prefix
+		case h.Suffix != "":
+			c.Kind, c.Pattern = HeaderSuffix, h.Suffix
+		case h.Contains != "":
+			c.Kind, c.Pattern = HeaderContains, h.Contains
+		case h.Range != nil:
+			c.Kind, c.Start, c.End = HeaderInRange, h.Range.Start, h.Range.End
+		}
+		if c.Kind != HeaderNonEmpty {
+			ch = append(ch, c)
 			continue
 		}
-
-		// ================= B) Trie：精确/前缀/变量 路由 =================
-		isPrefix := r.Match.Prefix != ""
-		methods := r.Match.Methods
-		if len(methods) == 0 {
-			methods = constMethods // 使用常量切片，避免每次分配
+		if h.Regex {
+			// 1) 模型已提供编译好的正则（若有）→ 直接用
+			if h.valueRE != nil {
+				c.Regex = h.valueRE
+			} else if len(h.Values) > 0 && h.Values[0] != "" {
+				// 2) 否则走全局缓存/编译（跨快照复用）
+				if re := getCachedRegexp(h.Values[0]); re != nil {
+					c.Regex = re
+				}
+			}
+		} else {
+			// not regex → 枚举值拷贝
+			if len(h.Values) > 0 {
+				// 注意：这里直接 append 值字符串（不可变），无需复制底层数组
+				c.Values = append(c.Values, h.Values...)
+			}
 		}
-		for _, m := range methods {
-			t := getTrie(m)
-			key := util.GetTrieKeyWithPrefix(m, r.Match.Path, r.Match.Prefix, isPrefix)
-			_, _ = t.Put(key, r.Route)
+		switch {
+		case c.Regex != nil:
+			c.Kind = HeaderRegex
+		case len(c.Values) > 0:
+			c.Kind = HeaderExact
 		}
+		ch = append(ch, c)
 	}
-	return s
+
+	// 把临时切片的内容转移到快照（拥有期在快照）
+	out := make([]CompiledHeader, len(ch))
+	copy(out, ch)
+
+	// 归还临时切片到池（清空引用，避免持有快照数据）
+	*chPtr = (*chPtr)[:0]
+	compiledHeaderSlicePool.Put(chPtr)
+
+	return out
 }
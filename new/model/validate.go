@@ -0,0 +1,273 @@
+package model
+
+import (
+	"fmt"
+	stdHttp "net/http"
+	"slices"
+	"strings"
+)
+
+import (
+	util "github.com/alanxtl/pixiu-router-update/utils"
+)
+
+// ValidationError an invalid field of a route or virtual host
+type ValidationError struct {
+	RouteID     string // empty for problems of a virtual host
+	VirtualHost string // virtual host of the route, empty for routes outside of any virtual host
+	Field       string // path of the field, e.g. match.headers[0].values
+	Message     string
+	// Fatal the route can not be compiled as configured, it is left out of every snapshot.
+	// Other problems are reported, the route is still served unless the publish is strict.
+	Fatal bool
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	if e.VirtualHost != "" {
+		b.WriteString("virtual host " + e.VirtualHost + ": ")
+	}
+	if e.RouteID != "" {
+		b.WriteString("route " + e.RouteID + ": ")
+	}
+	b.WriteString(e.Field + ": " + e.Message)
+	return b.String()
+}
+
+// ValidationErrors every problem found by a validation pass
+type ValidationErrors []*ValidationError
+
+func (es ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(es))
+	for _, e := range es {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Err nil when no problem was found, es otherwise
+func (es ValidationErrors) Err() error {
+	if len(es) == 0 {
+		return nil
+	}
+	return es
+}
+
+// Fatal the errors of es that keep a route out of the snapshot
+func (es ValidationErrors) Fatal() ValidationErrors {
+	var out ValidationErrors
+	for _, e := range es {
+		if e.Fatal {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// knownMethods the methods a route may list
+var knownMethods = []string{
+	stdHttp.MethodGet, stdHttp.MethodHead, stdHttp.MethodPost, stdHttp.MethodPut, stdHttp.MethodPatch,
+	stdHttp.MethodDelete, stdHttp.MethodConnect, stdHttp.MethodOptions, stdHttp.MethodTrace,
+}
+
+// ValidateRouter check everything the snapshot builder would otherwise drop or misread:
+// paths, regexes, header, query parameter and cookie matchers, methods and the action.
+// Invalid regexes and constraints, ** in the middle of a path and fields that exclude each other are Fatal,
+// an empty id or cluster, unknown methods and malformed but routable paths are not.
+func ValidateRouter(r *Router) ValidationErrors {
+	v := validator{route: r.ID}
+	if r.ID == "" {
+		v.add("id", "must not be empty")
+	}
+	m := &r.Match
+	set := 0
+	for _, s := range []string{m.Path, m.Prefix, m.Regex} {
+		if s != "" {
+			set++
+		}
+	}
+	switch {
+	case set > 1:
+		v.fatal("match", "only one of path, prefix and regex can be set")
+	case set == 0 && len(m.Headers) == 0 && len(m.QueryParams) == 0 && len(m.Cookies) == 0:
+		v.add("match", "one of path, prefix, regex, headers, query_params and cookies must be set")
+	}
+	if m.Path != "" {
+		v.path("match.path", m.Path, false)
+	}
+	if m.Prefix != "" {
+		v.path("match.prefix", m.Prefix, true)
+	}
+	if m.Regex != "" && util.GetCachedAnchoredRegexp(m.Regex) == nil {
+		v.fatal("match.regex", "invalid regex "+m.Regex)
+	}
+	for i, method := range m.Methods {
+		if !slices.Contains(knownMethods, method) {
+			v.add(fmt.Sprintf("match.methods[%d]", i), "unknown method "+method)
+		}
+	}
+	for i, h := range m.Headers {
+		field := fmt.Sprintf("match.headers[%d]", i)
+		if h.Name == "" {
+			v.add(field+".name", "must not be empty")
+		}
+		conditions := 0
+		for _, set := range []bool{len(h.Values) > 0 || h.Regex, h.Present, h.Absent, h.Prefix != "", h.Suffix != "", h.Contains != "", h.Range != nil} {
+			if set {
+				conditions++
+			}
+		}
+		switch {
+		case conditions > 1:
+			v.fatal(field, "only one of values, present, absent, prefix, suffix, contains and range can be set")
+		case h.Regex && (len(h.Values) == 0 || getCachedRegexp(h.Values[0]) == nil):
+			v.fatal(field+".values", "invalid regex")
+		case h.Range != nil && h.Range.End <= h.Range.Start:
+			v.add(field+".range", "end must be greater than start")
+		case h.IgnoreCase && (h.Regex || h.Present || h.Absent || h.Range != nil):
+			v.add(field+".ignore_case", "only applies to values, prefix, suffix and contains")
+		}
+	}
+	for i, q := range m.QueryParams {
+		field := fmt.Sprintf("match.query_params[%d]", i)
+		if q.Name == "" {
+			v.add(field+".name", "must not be empty")
+		}
+		switch {
+		case q.Present && q.Absent:
+			v.fatal(field, "only one of present and absent can be set")
+		case (q.Present || q.Absent) && len(q.Values) > 0:
+			v.fatal(field+".values", "must be empty with present or absent")
+		case q.Regex && (len(q.Values) == 0 || getCachedRegexp(q.Values[0]) == nil):
+			v.fatal(field+".values", "invalid regex")
+		}
+	}
+	for i, c := range m.Cookies {
+		field := fmt.Sprintf("match.cookies[%d]", i)
+		if c.Name == "" {
+			v.add(field+".name", "must not be empty")
+		}
+		switch {
+		case c.Present && len(c.Values) > 0:
+			v.fatal(field+".values", "must be empty with present")
+		case c.Regex && (len(c.Values) == 0 || getCachedRegexp(c.Values[0]) == nil):
+			v.fatal(field+".values", "invalid regex")
+		}
+	}
+
+	a := &r.Route
+	if err := validateAction(a); err != nil {
+		v.fatal("route", err.Error())
+	} else if a.Kind() == ActionCluster {
+		if a.WeightedClusters != nil {
+			if _, err := NewClusterSplit(a.WeightedClusters); err != nil {
+				v.fatal("route.weighted_clusters", err.Error())
+			}
+		} else if a.Cluster == "" {
+			v.add("route.cluster", "must not be empty")
+		}
+	}
+	return v.errs
+}
+
+// ValidateConfig validate every route and virtual host of cfg, route ids must be unique across virtual hosts
+func ValidateConfig(cfg *RouteConfiguration) error {
+	var errs ValidationErrors
+	seen := make(map[string]struct{}, len(cfg.Routes))
+	check := func(host string, routes []*Router) {
+		for _, r := range routes {
+			rerrs := ValidateRouter(r)
+			if _, dup := seen[r.ID]; dup && r.ID != "" {
+				rerrs = append(rerrs, &ValidationError{RouteID: r.ID, Field: "id", Message: "duplicated"})
+			}
+			seen[r.ID] = struct{}{}
+			for _, e := range rerrs {
+				e.VirtualHost = host
+			}
+			errs = append(errs, rerrs...)
+		}
+	}
+	check(DefaultHost, cfg.Routes)
+	errs = append(errs, ValidateVirtualHosts(cfg.VirtualHosts)...)
+	for _, vh := range cfg.VirtualHosts {
+		if vh != nil {
+			check(vh.Name, vh.Routes)
+		}
+	}
+	return errs.Err()
+}
+
+// ValidateVirtualHosts check names and domains, the routes of the virtual hosts are not checked
+func ValidateVirtualHosts(hosts []*VirtualHost) ValidationErrors {
+	var errs ValidationErrors
+	names := make(map[string]struct{}, len(hosts))
+	domains := make(map[string]string)
+	for i, vh := range hosts {
+		if vh == nil {
+			continue
+		}
+		add := func(field, msg string) {
+			errs = append(errs, &ValidationError{VirtualHost: vh.Name, Field: field, Message: msg})
+		}
+		if vh.Name == DefaultHost {
+			add(fmt.Sprintf("virtual_hosts[%d].name", i), "must not be empty")
+		} else if _, dup := names[vh.Name]; dup {
+			add("name", "duplicated")
+		}
+		names[vh.Name] = struct{}{}
+		if len(vh.Domains) == 0 {
+			add("domains", "must not be empty")
+		}
+		for j, d := range vh.Domains {
+			field := fmt.Sprintf("domains[%d]", j)
+			d = strings.ToLower(stripPort(d))
+			switch {
+			case d == "":
+				add(field, "must not be empty")
+			case d != "*" && strings.Contains(strings.TrimPrefix(d, "*."), "*"):
+				add(field, "a wildcard is only allowed as *.suffix or *")
+			}
+			if other, dup := domains[d]; dup {
+				add(field, "already used by virtual host "+other)
+			} else {
+				domains[d] = vh.Name
+			}
+		}
+	}
+	return errs
+}
+
+type validator struct {
+	route string
+	errs  ValidationErrors
+}
+
+func (v *validator) add(field, msg string) {
+	v.errs = append(v.errs, &ValidationError{RouteID: v.route, Field: field, Message: msg})
+}
+
+func (v *validator) fatal(field, msg string) {
+	v.errs = append(v.errs, &ValidationError{RouteID: v.route, Field: field, Message: msg, Fatal: true})
+}
+
+// path check a Path or a Prefix: absolute, no empty segment, ** only at the end of a path, valid variable constraints
+func (v *validator) path(field, p string, prefix bool) {
+	if !strings.HasPrefix(p, "/") {
+		v.add(field, "must start with /")
+		return
+	}
+	segs := util.Split(strings.TrimSuffix(p, "/"))
+	for i, seg := range segs {
+		last := i == len(segs)-1
+		switch {
+		case seg == "" && !(last && len(segs) == 1):
+			v.add(field, "empty segment in "+p)
+		case util.IsMatchAll(seg) && (prefix || !last):
+			v.fatal(field, "** is only allowed as the last segment of a path")
+		case util.IsPathVariableOrWildcard(seg):
+			if _, constraint := util.VariableConstraint(seg); constraint != "" && util.GetCachedAnchoredRegexp(constraint) == nil {
+				v.fatal(field, "invalid constraint of "+seg)
+			}
+		}
+	}
+}
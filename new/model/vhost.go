@@ -0,0 +1,85 @@
+package model
+
+import (
+	"net"
+	"sort"
+	"strings"
+)
+
+// DefaultHost name of the virtual host holding the routes outside of any virtual host
+const DefaultHost = ""
+
+// DomainIndex resolves a request host to the name of the virtual host serving it:
+// exact domain first, then the longest matching wildcard suffix, then the * virtual host,
+// then DefaultHost.
+type DomainIndex struct {
+	exact     map[string]string // host -> virtual host name
+	wildcards []wildcardDomain  // longest suffix first
+	fallback  string            // virtual host with the * domain, DefaultHost if none
+}
+
+type wildcardDomain struct {
+	suffix string // .example.com for *.example.com
+	name   string
+}
+
+// NewDomainIndex index the domains of hosts, a domain claimed twice goes to the first virtual host
+func NewDomainIndex(hosts []*VirtualHost) DomainIndex {
+	idx := DomainIndex{fallback: DefaultHost}
+	fallbackSet := false
+	seen := make(map[string]struct{})
+	for _, vh := range hosts {
+		if vh == nil || vh.Name == DefaultHost {
+			continue
+		}
+		for _, d := range vh.Domains {
+			d = strings.ToLower(stripPort(d))
+			if _, dup := seen[d]; dup {
+				continue
+			}
+			seen[d] = struct{}{}
+			switch {
+			case d == "*":
+				if !fallbackSet {
+					idx.fallback, fallbackSet = vh.Name, true
+				}
+			case strings.HasPrefix(d, "*."):
+				idx.wildcards = append(idx.wildcards, wildcardDomain{suffix: d[1:], name: vh.Name})
+			default:
+				if idx.exact == nil {
+					idx.exact = make(map[string]string)
+				}
+				idx.exact[d] = vh.Name
+			}
+		}
+	}
+	sort.SliceStable(idx.wildcards, func(i, j int) bool {
+		return len(idx.wildcards[i].suffix) > len(idx.wildcards[j].suffix)
+	})
+	return idx
+}
+
+// Resolve the name of the virtual host serving host, host may carry a port
+func (idx *DomainIndex) Resolve(host string) string {
+	if len(idx.exact) == 0 && len(idx.wildcards) == 0 {
+		return idx.fallback
+	}
+	host = strings.ToLower(stripPort(host))
+	if name, ok := idx.exact[host]; ok {
+		return name
+	}
+	for _, w := range idx.wildcards {
+		if len(host) > len(w.suffix) && strings.HasSuffix(host, w.suffix) {
+			return w.name
+		}
+	}
+	return idx.fallback
+}
+
+// stripPort host without its port, IPv6 literals lose their brackets
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
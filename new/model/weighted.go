@@ -0,0 +1,123 @@
+package model
+
+import (
+	"math/rand/v2"
+	stdHttp "net/http"
+)
+
+import (
+	"github.com/pkg/errors"
+)
+
+// WeightSource the randomness and hashing behind weighted cluster selection, it must be safe for concurrent use
+type WeightSource interface {
+	// Random a uniformly distributed value in [0, n)
+	Random(n uint64) uint64
+	// Hash a value in [0, n), always the same for the same key
+	Hash(key string, n uint64) uint64
+}
+
+// DefaultWeightSource math/rand for random splits, FNV-1a for sticky ones
+func DefaultWeightSource() WeightSource {
+	return defaultWeightSource{}
+}
+
+type defaultWeightSource struct{}
+
+func (defaultWeightSource) Random(n uint64) uint64 { return rand.Uint64N(n) }
+
+func (defaultWeightSource) Hash(key string, n uint64) uint64 {
+	// FNV-1a, inlined so hashing a key does not allocate
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h % n
+}
+
+// ClusterSplit the compiled WeightedClusters of a route
+type ClusterSplit struct {
+	names      []string
+	upper      []uint64 // cumulated weights, names[i] serves the values in [upper[i-1], upper[i])
+	hashHeader string
+	hashCookie string
+}
+
+// NewClusterSplit validate and compile wc:
+// at least one cluster, no empty or duplicated name, a positive total weight equal to TotalWeight when it is set,
+// and at most one of HashHeader and HashCookie.
+func NewClusterSplit(wc *WeightedClusters) (*ClusterSplit, error) {
+	if len(wc.Clusters) == 0 {
+		return nil, errors.New("weighted clusters: no cluster")
+	}
+	if wc.HashHeader != "" && wc.HashCookie != "" {
+		return nil, errors.New("weighted clusters: both hash_header and hash_cookie are set")
+	}
+	cs := &ClusterSplit{
+		names:      make([]string, 0, len(wc.Clusters)),
+		upper:      make([]uint64, 0, len(wc.Clusters)),
+		hashHeader: wc.HashHeader,
+		hashCookie: wc.HashCookie,
+	}
+	var total uint64
+	for i, c := range wc.Clusters {
+		if c.Name == "" {
+			return nil, errors.Errorf("weighted clusters: cluster[%d] has no name", i)
+		}
+		for _, n := range cs.names {
+			if n == c.Name {
+				return nil, errors.Errorf("weighted clusters: cluster %s is listed twice", c.Name)
+			}
+		}
+		total += uint64(c.Weight)
+		cs.names = append(cs.names, c.Name)
+		cs.upper = append(cs.upper, total)
+	}
+	if total == 0 {
+		return nil, errors.New("weighted clusters: total weight is 0")
+	}
+	if wc.TotalWeight != 0 && uint64(wc.TotalWeight) != total {
+		return nil, errors.Errorf("weighted clusters: weights sum to %d, total_weight is %d", total, wc.TotalWeight)
+	}
+	return cs, nil
+}
+
+// Pick the cluster of req, sticky on the hash header or cookie when the request carries it, random otherwise.
+// req may be nil.
+func (cs *ClusterSplit) Pick(src WeightSource, req *stdHttp.Request) string {
+	return cs.names[cs.pick(src, req)]
+}
+
+// pick the index of the cluster of req
+func (cs *ClusterSplit) pick(src WeightSource, req *stdHttp.Request) int {
+	total := cs.upper[len(cs.upper)-1]
+	var v uint64
+	if key, ok := cs.stickyKey(req); ok {
+		v = src.Hash(key, total)
+	} else {
+		v = src.Random(total)
+	}
+	for i, u := range cs.upper {
+		if v < u {
+			return i
+		}
+	}
+	return len(cs.names) - 1
+}
+
+func (cs *ClusterSplit) stickyKey(req *stdHttp.Request) (string, bool) {
+	if req == nil {
+		return "", false
+	}
+	if cs.hashHeader != "" {
+		v := req.Header.Get(cs.hashHeader)
+		return v, v != ""
+	}
+	if cs.hashCookie != "" {
+		if c, err := req.Cookie(cs.hashCookie); err == nil && c.Value != "" {
+			return c.Value, true
+		}
+	}
+	return "", false
+}
@@ -1,9 +1,15 @@
 package new
 
 import (
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
+	"maps"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,7 +17,6 @@ import (
 
 import (
 	"github.com/alanxtl/pixiu-router-update/new/model"
-	"github.com/alanxtl/pixiu-router-update/new/trie"
 	util "github.com/alanxtl/pixiu-router-update/utils"
 )
 
@@ -20,166 +25,1090 @@ type RouterCoordinator struct {
 	active   snapshotHolder // atomic snapshot
 	mu       sync.Mutex
 	store    map[string]*model.Router
-	timer    *time.Timer   // debounce timer
-	debounce time.Duration // merge window, default 50ms
+	timer    *time.Timer                        // debounce timer, guarded by mu
+	debounce time.Duration                      // merge window, default 50ms, guarded by mu
+	maxDelay time.Duration                      // longest wait of a change before it is published, default 500ms, guarded by mu
+	pending  time.Time                          // first change since the last publish, zero when nothing is pending, guarded by mu
+	closed   bool                               // guarded by mu
+	weights  atomic.Pointer[model.WeightSource] // see SetWeightSource
+	mode     PublishMode                        // guarded by mu
+	lastErr  error                              // validation errors of the last publish, guarded by mu
+
+	// published snapshots, guarded by mu
+	history      []revision // oldest first, the last one is active
+	historyBase  routeSet   // routes of history[0], the later revisions only record their changes
+	historyLimit int        // snapshots kept in history, default 10
+	version      uint64     // version of the last published snapshot
+
+	subs map[*subscriber]struct{} // guarded by mu
+
+	// virtual hosts, guarded by mu
+	hostOf       map[string]string    // route id -> virtual host name, absent for model.DefaultHost
+	vhosts       []*model.VirtualHost // name and domains of the virtual hosts, in config order
+	published    []*model.VirtualHost // vhosts of the active snapshot, restored when a strict publish is rejected
+	domainsDirty bool                 // vhosts changed since the last publish
+
+	// bookkeeping of the active snapshot, guarded by mu
+	seq       map[string]uint64                // route id -> insertion order, kept when a route is replaced
+	nextSeq   uint64                           // insertion order of the next new route
+	placed    map[string]placement             // route id -> where the route sits in the active snapshot
+	owners    map[model.TrieKey][]string       // trie key -> ids of routes claiming it, in insertion order
+	conflicts map[model.TrieKey]model.Conflict // trie key -> routes shadowed in the active snapshot
+	dirty     map[string]struct{}              // ids of routes changed since the last publish
+	swaps     map[string]struct{}              // dirty ids whose published route only differs by its action
+}
+
+var (
+	errEmptyConfig = errors.New("router configuration is empty")
+	errNoRoute     = errors.New("no route matched")
+)
+
+// paramsPool buffers the path variable values of a lookup are appended to
+var paramsPool = sync.Pool{
+	New: func() any {
+		s := make([]string, 0, 8)
+		return &s
+	},
+}
+
+// releaseParams drop the values of buf, they point into a request path, and return it to the pool
+func releaseParams(buf *[]string) {
+	clear((*buf)[:cap(*buf)])
+	paramsPool.Put(buf)
+}
+
+// PublishMode how a publish handles invalid routes and virtual hosts
+type PublishMode int
+
+const (
+	// PublishLenient routes with a model.ValidationError.Fatal problem are left out of the snapshot,
+	// the other changes are published, invalid or not
+	PublishLenient PublishMode = iota
+	// PublishStrict a publish with any invalid change is rejected as a whole, the active snapshot stays
+	PublishStrict
+)
+
+// revision a published snapshot and the changes of its routes since the previous revision,
+// so that a publish records O(changes) and Rollback rebuilds the routes from historyBase
+type revision struct {
+	snapshot  *model.RouteSnapshot
+	published time.Time
+	routes    int                               // number of routes of every virtual host
+	changed   map[string]routeState             // changed routes by id, a removed route has a nil route
+	conflicts map[model.TrieKey]*model.Conflict // changed conflicts by key, nil when the key has no conflict any more
+	vhosts    []*model.VirtualHost
+}
+
+// routeState a route of a revision, where it lives and its insertion order
+type routeState struct {
+	route *model.Router
+	host  string
+	seq   uint64
+}
+
+// routeSet the routes of a revision, as kept in the bookkeeping of the coordinator
+type routeSet struct {
+	store     map[string]*model.Router
+	hostOf    map[string]string
+	seq       map[string]uint64
+	conflicts map[model.TrieKey]model.Conflict
+}
+
+func (rs *routeSet) clone() routeSet {
+	return routeSet{
+		store:     maps.Clone(rs.store),
+		hostOf:    maps.Clone(rs.hostOf),
+		seq:       maps.Clone(rs.seq),
+		conflicts: maps.Clone(rs.conflicts),
+	}
+}
+
+// apply the changes of rev
+func (rs *routeSet) apply(rev *revision) {
+	for id, st := range rev.changed {
+		if st.route == nil {
+			delete(rs.store, id)
+			delete(rs.hostOf, id)
+			delete(rs.seq, id)
+			continue
+		}
+		rs.store[id] = st.route
+		rs.seq[id] = st.seq
+		if st.host == model.DefaultHost {
+			delete(rs.hostOf, id)
+		} else {
+			rs.hostOf[id] = st.host
+		}
+	}
+	for k, c := range rev.conflicts {
+		if c == nil {
+			delete(rs.conflicts, k)
+		} else {
+			rs.conflicts[k] = *c
+		}
+	}
+}
+
+// SnapshotVersion a snapshot kept in the history of the coordinator
+type SnapshotVersion struct {
+	Version     uint64
+	PublishedAt time.Time
+	Routes      int  // number of routes of every virtual host
+	Active      bool // currently serving requests
+}
+
+// placement where a published route sits in the snapshot
+type placement struct {
+	route *model.Router
+	seq   uint64
+	host  string
+	kind  model.RouteKind
+	keys  []model.TrieKey
 }
 
 func CreateRouterCoordinator(routeConfig *model.RouteConfiguration) *RouterCoordinator {
 	rc := &RouterCoordinator{
-		store:    make(map[string]*model.Router),
-		debounce: 50 * time.Millisecond, // merge window
+		store:        make(map[string]*model.Router),
+		debounce:     50 * time.Millisecond, // merge window
+		maxDelay:     500 * time.Millisecond,
+		historyLimit: 10,
+		hostOf:       make(map[string]string),
+		seq:          make(map[string]uint64, len(routeConfig.Routes)),
+		placed:       make(map[string]placement, len(routeConfig.Routes)),
+		owners:       make(map[model.TrieKey][]string, len(routeConfig.Routes)),
+		conflicts:    make(map[model.TrieKey]model.Conflict),
+		dirty:        make(map[string]struct{}),
+		swaps:        make(map[string]struct{}),
 	}
-	// build initial config and store snapshot
-	first := buildConfig(routeConfig.Routes)
-	rc.active.store(model.ToSnapshot(first))
-	// copy initial routes to store
-	for _, r := range routeConfig.Routes {
-		rc.store[r.ID] = r
+	rc.SetWeightSource(model.DefaultWeightSource())
+	// build initial config
+	first := buildConfig(routeConfig)
+	s, conflicts := model.BuildSnapshot(first)
+	for _, c := range conflicts {
+		rc.conflicts[c.Key] = c
+	}
+	rc.lastErr = model.ValidateConfig(routeConfig)
+	// copy initial routes to store, owners of a key in config order as in ToSnapshot
+	rc.track(model.DefaultHost, first.Routes)
+	seen := make(map[string]struct{}, len(first.VirtualHosts))
+	for _, vh := range first.VirtualHosts {
+		if vh == nil || vh.Name == model.DefaultHost {
+			continue
+		}
+		if _, dup := seen[vh.Name]; dup {
+			continue
+		}
+		seen[vh.Name] = struct{}{}
+		rc.vhosts = append(rc.vhosts, &model.VirtualHost{Name: vh.Name, Domains: vh.Domains})
+		rc.track(vh.Name, vh.Routes)
 	}
+	rc.published = slices.Clone(rc.vhosts)
+	// store snapshot
+	rc.commitLocked(s, SnapshotEvent{}, nil, nil)
 	return rc
 }
 
+// CreateValidatedRouterCoordinator like CreateRouterCoordinator, but fails on an invalid config
+// and returns a coordinator in PublishStrict mode
+func CreateValidatedRouterCoordinator(routeConfig *model.RouteConfiguration) (*RouterCoordinator, error) {
+	if err := model.ValidateConfig(routeConfig); err != nil {
+		return nil, err
+	}
+	rc := CreateRouterCoordinator(routeConfig)
+	rc.mode = PublishStrict
+	return rc, nil
+}
+
+// track record the initial routes of host in the bookkeeping
+func (rm *RouterCoordinator) track(host string, routes []*model.Router) {
+	for _, r := range routes {
+		rm.store[r.ID] = r
+		if host != model.DefaultHost {
+			rm.hostOf[r.ID] = host
+		}
+		rm.seq[r.ID] = rm.nextSeq
+		rm.nextSeq++
+		p := placement{route: r, seq: rm.seq[r.ID], host: host, kind: model.KindOf(r), keys: model.TrieKeys(host, r)}
+		rm.placed[r.ID] = p
+		for _, k := range p.keys {
+			rm.owners[k] = append(rm.owners[k], r.ID)
+		}
+	}
+}
+
+// SetPublishMode choose how the next publishes handle invalid changes, PublishLenient by default
+func (rm *RouterCoordinator) SetPublishMode(mode PublishMode) {
+	rm.mu.Lock()
+	rm.mode = mode
+	rm.mu.Unlock()
+}
+
+// LastPublishError the model.ValidationErrors found by the last publish, nil when every change was valid.
+// In PublishLenient mode only the routes with a fatal error were left out, in PublishStrict mode the whole publish was rejected.
+func (rm *RouterCoordinator) LastPublishError() error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return rm.lastErr
+}
+
+// Version the version of the active snapshot
+func (rm *RouterCoordinator) Version() uint64 {
+	return rm.active.load().Version
+}
+
+// Versions the snapshots kept in history, oldest first
+func (rm *RouterCoordinator) Versions() []SnapshotVersion {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	out := make([]SnapshotVersion, 0, len(rm.history))
+	for i, rev := range rm.history {
+		out = append(out, SnapshotVersion{
+			Version:     rev.snapshot.Version,
+			PublishedAt: rev.published,
+			Routes:      rev.routes,
+			Active:      i == len(rm.history)-1,
+		})
+	}
+	return out
+}
+
+// SetHistoryLimit keep the last n published snapshots for Rollback, n includes the active one and is at least 1
+func (rm *RouterCoordinator) SetHistoryLimit(n int) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.historyLimit = max(n, 1)
+	rm.trimHistoryLocked()
+}
+
+// Rollback serve the routes of a snapshot of the history again, published as a new version.
+// Changes not published yet are dropped.
+func (rm *RouterCoordinator) Rollback(version uint64) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	i := slices.IndexFunc(rm.history, func(rev revision) bool { return rev.snapshot.Version == version })
+	if i < 0 {
+		return fmt.Errorf("snapshot version %d is not in history", version)
+	}
+	start := time.Now()
+	rev := rm.history[i]
+	rs := rm.historyBase.clone()
+	for j := 1; j <= i; j++ {
+		rs.apply(&rm.history[j])
+	}
+	// unpublished changes are dropped: compare with the routes of the active snapshot
+	rm.rejectLocked()
+	ev := SnapshotEvent{Rollback: true, VirtualHostsChanged: !slices.Equal(rm.published, rev.vhosts)}
+	var changed []string
+	for id, r := range rs.store {
+		if old, ok := rm.store[id]; !ok {
+			ev.Added = append(ev.Added, id)
+			changed = append(changed, id)
+		} else if old != r || rm.hostOf[id] != rs.hostOf[id] {
+			ev.Changed = append(ev.Changed, id)
+			changed = append(changed, id)
+		} else if rm.seq[id] != rs.seq[id] {
+			changed = append(changed, id)
+		}
+	}
+	for id := range rm.store {
+		if _, ok := rs.store[id]; !ok {
+			ev.Removed = append(ev.Removed, id)
+			changed = append(changed, id)
+		}
+	}
+	// conflicts are few, the revision records all of them
+	keys := make(map[model.TrieKey]struct{}, len(rs.conflicts)+len(rm.conflicts))
+	for k := range rs.conflicts {
+		keys[k] = struct{}{}
+	}
+	for k := range rm.conflicts {
+		keys[k] = struct{}{}
+	}
+	slices.Sort(ev.Added)
+	slices.Sort(ev.Removed)
+	slices.Sort(ev.Changed)
+	rm.store, rm.hostOf, rm.seq, rm.conflicts = rs.store, rs.hostOf, rs.seq, rs.conflicts
+	rm.vhosts = slices.Clone(rev.vhosts)
+	rm.published = slices.Clone(rev.vhosts)
+	clear(rm.dirty)
+	clear(rm.swaps)
+	rm.domainsDirty = false
+	rm.pending = time.Time{}
+	rm.lastErr = nil
+	// placements and owners follow from the routes
+	clear(rm.placed)
+	clear(rm.owners)
+	for id, r := range rm.store {
+		host := rm.hostOf[id]
+		p := placement{route: r, seq: rm.seq[id], host: host, kind: model.KindOf(r), keys: model.TrieKeys(host, r)}
+		rm.placed[id] = p
+		for _, k := range p.keys {
+			rm.owners[k] = append(rm.owners[k], id)
+		}
+	}
+	for _, owners := range rm.owners {
+		slices.SortFunc(owners, func(a, b string) int { return cmp.Compare(rm.seq[a], rm.seq[b]) })
+	}
+	// the snapshot is immutable, share everything but the version
+	s := *rev.snapshot
+	ev.BuildDuration = time.Since(start)
+	rm.commitLocked(&s, ev, changed, keys)
+	return nil
+}
+
+// SetWeightSource replace the randomness and hashing used to pick weighted clusters, requests may be routed meanwhile
+func (rm *RouterCoordinator) SetWeightSource(src model.WeightSource) {
+	rm.weights.Store(&src)
+}
+
+// weightSource the source set by SetWeightSource
+func (rm *RouterCoordinator) weightSource() model.WeightSource {
+	return *rm.weights.Load()
+}
+
+// Route the action of the route matching req, it belongs to the active snapshot and must not be modified
 func (rm *RouterCoordinator) Route(req *http.Request) (*model.RouteAction, error) {
+	buf := paramsPool.Get().(*[]string)
+	defer releaseParams(buf)
+	e, _, err := rm.lookup(req, (*buf)[:0])
+	if err != nil {
+		return nil, err
+	}
+	return e.ResolveShared(rm.weightSource(), req), nil
+}
+
+// RouteByPathAndName weighted clusters are never sticky here, there is no request to hash.
+// The action belongs to the active snapshot and must not be modified.
+func (rm *RouterCoordinator) RouteByPathAndName(path, method string) (*model.RouteAction, error) {
+	buf := paramsPool.Get().(*[]string)
+	defer releaseParams(buf)
+	e, _, err := rm.lookupByPathAndName(path, method, (*buf)[:0])
+	if err != nil {
+		return nil, err
+	}
+	return e.ResolveShared(rm.weightSource(), nil), nil
+}
+
+// MatchRoute like Route, also returns the matched route id, pattern and path parameters
+func (rm *RouterCoordinator) MatchRoute(req *http.Request) (*model.MatchResult, error) {
+	buf := paramsPool.Get().(*[]string)
+	defer releaseParams(buf)
+	e, values, err := rm.lookup(req, (*buf)[:0])
+	if err != nil {
+		return nil, err
+	}
+	res := e.Result(req.URL.Path, values)
+	res.Action = e.Resolve(rm.weightSource(), req)
+	return res, nil
+}
+
+// MatchRouteByPathAndName like RouteByPathAndName, also returns the matched route id, pattern and path parameters
+func (rm *RouterCoordinator) MatchRouteByPathAndName(path, method string) (*model.MatchResult, error) {
+	buf := paramsPool.Get().(*[]string)
+	defer releaseParams(buf)
+	e, values, err := rm.lookupByPathAndName(path, method, (*buf)[:0])
+	if err != nil {
+		return nil, err
+	}
+	res := e.Result(pathOnly(path), values)
+	res.Action = e.Resolve(rm.weightSource(), nil)
+	return res, nil
+}
+
+// lookup in the virtual host of the request: header-only routes first, then the method trie, then the regex routes.
+// Path variable values of a trie route are appended to params.
+func (rm *RouterCoordinator) lookup(req *http.Request, params []string) (*model.RouteEntry, []string, error) {
 	s := rm.active.load()
 	if s == nil {
-		return nil, errors.New("router configuration is empty")
+		return nil, nil, errEmptyConfig
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
 	}
+	t := s.Table(host)
+	if t == nil {
+		return nil, nil, errNoRoute
+	}
+	in := matchInput{req: req, rawQuery: req.URL.RawQuery}
 	// header-only first
-	for _, hr := range s.HeaderOnly {
-		if !model.MethodAllowed(hr.Methods, req.Method) {
-			continue
-		}
-		if matchHeaders(hr.Headers, req) {
-			return &hr.Action, nil
+	if len(t.HeaderOnly) > 0 {
+		hr := t.HeaderIndex.First(t.HeaderOnly, req.Header, func(hr *model.HeaderRoute) bool {
+			return model.MethodAllowed(hr.Methods, req.Method) && in.matches(hr.Headers, hr.Query, hr.Cookies)
+		})
+		if hr != nil {
+			return &hr.RouteEntry, nil, nil
 		}
 	}
 	// Trie
-	t := s.MethodTries[req.Method]
-	if t == nil {
-		return nil, errors.New("no route matched")
+	if e, values, ok := matchTrie(t, req.URL.Path, req.Method, &in, params); ok {
+		return e, values, nil
 	}
-
-	node, _, ok := t.Match(util.GetTrieKey(req.Method, req.URL.Path))
-	if !ok || node == nil || node.GetBizInfo() == nil {
-		return nil, errors.New("no route matched")
+	// Regex
+	if e, values, ok := matchRegex(t, req.URL.Path, req.Method, &in); ok {
+		return e, values, nil
 	}
-	act := node.GetBizInfo().(model.RouteAction)
-	return &act, nil
+	return nil, nil, errNoRoute
 }
 
-func (rm *RouterCoordinator) RouteByPathAndName(path, method string) (*model.RouteAction, error) {
+// lookupByPathAndName the virtual host is taken from the host of an absolute path, the default one otherwise
+func (rm *RouterCoordinator) lookupByPathAndName(path, method string, params []string) (*model.RouteEntry, []string, error) {
 	s := rm.active.load()
 	if s == nil {
-		return nil, errors.New("router configuration is empty")
+		return nil, nil, errEmptyConfig
 	}
-	t := s.MethodTries[method]
+	t := s.Table(hostOfPath(path))
 	if t == nil {
-		return nil, errors.New("no route matched")
+		return nil, nil, errNoRoute
+	}
+	var in matchInput
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		in.rawQuery = path[i+1:]
+	}
+	if e, values, ok := matchTrie(t, path, method, &in, params); ok {
+		return e, values, nil
+	}
+	if e, values, ok := matchRegex(t, pathOnly(path), method, &in); ok {
+		return e, values, nil
+	}
+	return nil, nil, errNoRoute
+}
+
+// matchTrie first trie candidate matching path, headers, query parameters and cookies.
+// When no candidate of a node matches, the next node matching the path is tried.
+func matchTrie(t *model.RouteTable, path, method string, in *matchInput, params []string) (*model.RouteEntry, []string, bool) {
+	rt := t.MethodRadix[method]
+	if rt == nil {
+		return nil, nil, false
+	}
+	var hit *model.RouteEntry
+	rest, more := util.TrieKeyPath(path)
+	_, values, ok := rt.MatchAppend(method, rest, more, func(leaf *model.TrieLeaf) bool {
+		if leaf == nil {
+			return false
+		}
+		for i := range leaf.Candidates {
+			c := &leaf.Candidates[i]
+			if c.Conditional() && !in.matches(c.Headers, c.Query, c.Cookies) {
+				continue
+			}
+			hit = c.RouteEntry
+			return true
+		}
+		return false
+	}, params)
+	if !ok || hit == nil {
+		return nil, nil, false
+	}
+	return hit, values, true
+}
+
+// matchRegex first regex route matching path, headers, query parameters and cookies
+func matchRegex(t *model.RouteTable, path, method string, in *matchInput) (*model.RouteEntry, []string, bool) {
+	for i := range t.Regex {
+		rr := &t.Regex[i]
+		if !model.MethodAllowed(rr.Methods, method) || !rr.Path.MatchString(path) {
+			continue
+		}
+		if !in.matches(rr.Headers, rr.Query, rr.Cookies) {
+			continue
+		}
+		return &rr.RouteEntry, rr.Values(path), true
+	}
+	return nil, nil, false
+}
+
+// pathOnly the path of an absolute or relative path, without host and query
+func pathOnly(path string) string {
+	if i := strings.Index(path, "://"); i >= 0 {
+		path = path[i+len("://"):]
+		j := strings.IndexAny(path, "/?")
+		if j < 0 {
+			return "/"
+		}
+		path = path[j:]
+	}
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
 	}
-	node, _, ok := t.Match(util.GetTrieKey(method, path))
-	if !ok || node == nil || node.GetBizInfo() == nil {
-		return nil, errors.New("no route matched")
+	if path == "" || path[0] != '/' {
+		path = "/" + path
 	}
-	act := node.GetBizInfo().(model.RouteAction)
-	return &act, nil
+	return path
 }
 
+// hostOfPath the host of an absolute path (http://host/path), empty otherwise
+func hostOfPath(path string) string {
+	i := strings.Index(path, "://")
+	if i < 0 {
+		return ""
+	}
+	host := path[i+len("://"):]
+	if j := strings.IndexAny(host, "/?"); j >= 0 {
+		host = host[:j]
+	}
+	return host
+}
+
+// OnAddRouter add or replace a route outside of any virtual host
 func (rm *RouterCoordinator) OnAddRouter(r *model.Router) {
+	rm.OnAddVirtualHostRouter(model.DefaultHost, r)
+}
+
+// OnAddVirtualHostRouter add or replace a route of the virtual host named host, a route of another host with the same id is moved.
+// The route is not served before the virtual host gets its domains through the config or OnAddVirtualHost.
+func (rm *RouterCoordinator) OnAddVirtualHostRouter(host string, r *model.Router) {
 	rm.mu.Lock()
-	rm.store[r.ID] = r
+	rm.addLocked(host, r)
 	rm.schedulePublishLocked()
 	rm.mu.Unlock()
 }
 
+// RouteUpdate what OnUpdateRouter changed
+type RouteUpdate struct {
+	Existed       bool // false when there was no route with the id, nothing is changed then
+	MatchChanged  bool // path, methods, headers, query parameters or priority changed
+	ActionChanged bool
+}
+
+// OnUpdateRouter replace the route with the id of r, in its virtual host.
+// When only the action changed since the last publish, the next snapshot swaps the action in the leaves of the route
+// and keeps the trie as is.
+// The coordinator keeps r, it must not be modified afterwards: the route passed again after a change in place
+// can not be compared with its previous version, it is reported as changed and placed again.
+func (rm *RouterCoordinator) OnUpdateRouter(r *model.Router) RouteUpdate {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	old, ok := rm.store[r.ID]
+	if !ok {
+		return RouteUpdate{}
+	}
+	u := RouteUpdate{Existed: true, MatchChanged: true, ActionChanged: true}
+	if old != r {
+		u.MatchChanged, u.ActionChanged = !old.SameMatch(r), !old.SameAction(r)
+	}
+	if !u.MatchChanged && !u.ActionChanged {
+		return u
+	}
+	host := rm.hostOf[r.ID]
+	rm.addLocked(host, r)
+	if p, ok := rm.placed[r.ID]; ok && p.route != r && p.host == host && p.seq == rm.seq[r.ID] && p.route.SameMatch(r) {
+		rm.swaps[r.ID] = struct{}{}
+	}
+	rm.schedulePublishLocked()
+	return u
+}
+
 func (rm *RouterCoordinator) OnDeleteRouter(r *model.Router) {
 	rm.mu.Lock()
-	delete(rm.store, r.ID)
+	rm.deleteLocked(r.ID)
 	rm.schedulePublishLocked()
 	rm.mu.Unlock()
 }
 
+// OnAddVirtualHost add or replace a virtual host: its domains, and its routes replace the ones it had
+func (rm *RouterCoordinator) OnAddVirtualHost(vh *model.VirtualHost) {
+	if vh == nil || vh.Name == model.DefaultHost {
+		return
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	keep := make(map[string]struct{}, len(vh.Routes))
+	for _, r := range vh.Routes {
+		keep[r.ID] = struct{}{}
+	}
+	for id, h := range rm.hostOf {
+		if _, ok := keep[id]; h == vh.Name && !ok {
+			rm.deleteLocked(id)
+		}
+	}
+	for _, r := range vh.Routes {
+		rm.addLocked(vh.Name, r)
+	}
+	entry := &model.VirtualHost{Name: vh.Name, Domains: slices.Clone(vh.Domains)}
+	if i := slices.IndexFunc(rm.vhosts, func(o *model.VirtualHost) bool { return o.Name == vh.Name }); i >= 0 {
+		rm.vhosts[i] = entry
+	} else {
+		rm.vhosts = append(rm.vhosts, entry)
+	}
+	rm.domainsDirty = true
+	rm.schedulePublishLocked()
+}
+
+// OnDeleteVirtualHost remove a virtual host and its routes
+func (rm *RouterCoordinator) OnDeleteVirtualHost(name string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	i := slices.IndexFunc(rm.vhosts, func(o *model.VirtualHost) bool { return o.Name == name })
+	if i < 0 {
+		return
+	}
+	rm.vhosts = slices.Delete(rm.vhosts, i, i+1)
+	for id, h := range rm.hostOf {
+		if h == name {
+			rm.deleteLocked(id)
+		}
+	}
+	rm.domainsDirty = true
+	rm.schedulePublishLocked()
+}
+
+// Conflicts routes of the active snapshot that can never match, because another route of the same path always wins
+func (rm *RouterCoordinator) Conflicts() []model.Conflict {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	out := make([]model.Conflict, 0, len(rm.conflicts))
+	for _, c := range rm.conflicts {
+		out = append(out, c)
+	}
+	model.SortConflicts(out)
+	return out
+}
+
+func (rm *RouterCoordinator) addLocked(host string, r *model.Router) {
+	delete(rm.swaps, r.ID)
+	rm.store[r.ID] = r
+	if _, ok := rm.seq[r.ID]; !ok {
+		rm.seq[r.ID] = rm.nextSeq
+		rm.nextSeq++
+	}
+	if host == model.DefaultHost {
+		delete(rm.hostOf, r.ID)
+	} else {
+		rm.hostOf[r.ID] = host
+	}
+	rm.dirty[r.ID] = struct{}{}
+}
+
+func (rm *RouterCoordinator) deleteLocked(id string) {
+	delete(rm.swaps, id)
+	delete(rm.store, id)
+	delete(rm.seq, id)
+	delete(rm.hostOf, id)
+	rm.dirty[id] = struct{}{}
+}
+
+// SetDebounce set the merge window of the changes and the longest a change can wait for a publish,
+// so a constant stream of changes can not postpone it forever.
+// A debounce <= 0 publishes every change immediately, a maxDelay <= 0 lets the window slide without bound.
+func (rm *RouterCoordinator) SetDebounce(debounce, maxDelay time.Duration) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.debounce, rm.maxDelay = debounce, maxDelay
+	if !rm.pending.IsZero() {
+		rm.schedulePublishLocked()
+	}
+}
+
+// Flush publish the pending changes now and wait for the switch to the new snapshot.
+// It returns ctx.Err() when ctx is done first, the publish then still completes in the background.
+// Validation errors are reported by LastPublishError.
+func (rm *RouterCoordinator) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		rm.mu.Lock()
+		rm.stopTimerLocked()
+		rm.publishLocked()
+		rm.mu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close publish the pending changes, stop the debounce timer and the subscribers once their events are delivered.
+// The coordinator keeps serving, changes made after Close are published immediately.
+func (rm *RouterCoordinator) Close() error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.closed {
+		return nil
+	}
+	rm.stopTimerLocked()
+	rm.publishLocked()
+	rm.closed = true
+	for sub := range rm.subs {
+		sub.close()
+	}
+	clear(rm.subs)
+	return nil
+}
+
 // reset timer or publish directly
 func (rm *RouterCoordinator) schedulePublishLocked() {
-	if rm.debounce <= 0 {
+	if rm.debounce <= 0 || rm.closed {
 		// fallback: immediate
+		rm.stopTimerLocked()
 		rm.publishLocked()
 		return
 	}
+	now := time.Now()
+	if rm.pending.IsZero() {
+		rm.pending = now
+	}
+	wait := rm.debounce
+	if rm.maxDelay > 0 {
+		wait = min(wait, rm.pending.Add(rm.maxDelay).Sub(now))
+	}
 	if rm.timer == nil {
-		rm.timer = time.NewTimer(rm.debounce)
-		go rm.awaitAndPublish()
+		rm.timer = time.AfterFunc(wait, rm.publishPending)
 		return
 	}
-	// clear timer channel
-	if !rm.timer.Stop() {
-		select {
-		case <-rm.timer.C:
-		default:
-		}
-	}
-	rm.timer.Reset(rm.debounce)
+	rm.timer.Reset(wait)
 }
 
-// wait for timer and publish
-func (rm *RouterCoordinator) awaitAndPublish() {
-	<-rm.timer.C
+// publishPending run by the debounce timer.
+// A run left behind by Flush or a reset timer finds nothing pending or publishes a bit early, both are harmless.
+func (rm *RouterCoordinator) publishPending() {
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
 	rm.publishLocked()
-	rm.timer = nil
 }
 
-// publish: clone from store -> build new config -> atomic switch
+func (rm *RouterCoordinator) stopTimerLocked() {
+	if rm.timer != nil {
+		rm.timer.Stop()
+	}
+}
+
+// publish: apply dirty routes on a copy-on-write fork of the active snapshot -> atomic switch
 func (rm *RouterCoordinator) publishLocked() {
-	// 1) clone routes
-	next := make([]*model.Router, 0, len(rm.store))
-	for _, r := range rm.store {
-		next = append(next, r)
+	rm.pending = time.Time{}
+	if len(rm.dirty) == 0 && !rm.domainsDirty {
+		return
+	}
+	start := time.Now()
+	rm.lastErr = rm.validateLocked()
+	if rm.lastErr != nil && rm.mode == PublishStrict {
+		rm.rejectLocked()
+		return
+	}
+	ev := SnapshotEvent{VirtualHostsChanged: rm.domainsDirty}
+	b := model.NewSnapshotBuilder(rm.active.load())
+	if rm.domainsDirty {
+		b.SetDomains(model.NewDomainIndex(rm.vhosts))
+		rm.published = slices.Clone(rm.vhosts)
+		rm.domainsDirty = false
+	}
+	// 1) move the dirty routes in the bookkeeping, collect the touched keys.
+	// Deleted routes go first, then the others in insertion order, so new routes are appended deterministically.
+	ids := make([]string, 0, len(rm.dirty))
+	for id := range rm.dirty {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, func(a, b string) int {
+		sa, oka := rm.seq[a]
+		sb, okb := rm.seq[b]
+		if oka != okb {
+			return boolRank(oka) - boolRank(okb)
+		}
+		return cmp.Or(cmp.Compare(sa, sb), cmp.Compare(a, b))
+	})
+	touched := make(map[model.TrieKey]struct{})
+	var swapped []string
+	for _, id := range ids {
+		if _, ok := rm.swaps[id]; ok {
+			// action only: same keys, same owners, same conflicts
+			p := rm.placed[id]
+			p.route = rm.store[id]
+			rm.placed[id] = p
+			ev.Changed = append(ev.Changed, id)
+			if p.kind != model.KindTrie {
+				b.ReplaceScanRoute(p.host, p.route, p.seq)
+			} else {
+				swapped = append(swapped, id)
+			}
+			continue
+		}
+		prev, had := rm.placed[id]
+		r, has := rm.store[id]
+		var cur placement
+		if has {
+			host := rm.hostOf[id]
+			cur = placement{route: r, seq: rm.seq[id], host: host, kind: model.KindOf(r), keys: model.TrieKeys(host, r)}
+			rm.placed[id] = cur
+		} else {
+			delete(rm.placed, id)
+		}
+		// deleted then added again since the last publish: a new insertion
+		renewed := had && has && prev.seq != cur.seq
+		switch {
+		case !had && has:
+			ev.Added = append(ev.Added, id)
+		case had && !has:
+			ev.Removed = append(ev.Removed, id)
+		case had && has:
+			ev.Changed = append(ev.Changed, id)
+		}
+
+		// header-only and regex routes
+		wasScan := had && prev.kind != model.KindTrie
+		isScan := has && cur.kind != model.KindTrie
+		switch {
+		case wasScan && isScan && !renewed && prev.kind == cur.kind && prev.host == cur.host:
+			b.ReplaceScanRoute(cur.host, r, cur.seq)
+		default:
+			if wasScan {
+				b.RemoveScanRoute(prev.host, id, prev.kind)
+			}
+			if isScan {
+				b.AddScanRoute(cur.host, r, cur.seq)
+			}
+		}
+
+		for _, k := range prev.keys {
+			if renewed || !slices.Contains(cur.keys, k) {
+				rm.owners[k] = slices.DeleteFunc(rm.owners[k], func(o string) bool { return o == id })
+			}
+			touched[k] = struct{}{}
+		}
+		for _, k := range cur.keys {
+			if renewed || !slices.Contains(prev.keys, k) {
+				owners := append(rm.owners[k], id)
+				slices.SortStableFunc(owners, func(a, b string) int { return cmp.Compare(rm.seq[a], rm.seq[b]) })
+				rm.owners[k] = owners
+			}
+			touched[k] = struct{}{}
+		}
+	}
+	clear(rm.dirty)
+	clear(rm.swaps)
+	// 2) rewrite the touched keys only
+	cands := make(map[string]model.TrieCandidate, len(touched))
+	for k := range touched {
+		rm.rewriteKeyLocked(b, k, cands)
+	}
+	// swap the actions in the leaves left alone by the rewrite, rewrite the ones without a candidate of the route
+	for _, id := range swapped {
+		p := rm.placed[id]
+		e, err := model.NewRouteEntry(p.route)
+		for _, k := range p.keys {
+			if _, ok := touched[k]; ok || (err == nil && b.SwapAction(k, e)) {
+				continue
+			}
+			rm.rewriteKeyLocked(b, k, cands)
+			touched[k] = struct{}{}
+		}
 	}
-	// 2) build new config
-	cfg := buildConfig(next)
 	// 3) atomic switch
-	rm.active.store(model.ToSnapshot(cfg))
+	s := b.Build()
+	slices.Sort(ev.Added)
+	slices.Sort(ev.Removed)
+	slices.Sort(ev.Changed)
+	ev.BuildDuration = time.Since(start)
+	rm.commitLocked(s, ev, ids, touched)
+}
+
+// rewriteKeyLocked build the leaf of k from its owners, cands caches the compiled candidates by route id
+func (rm *RouterCoordinator) rewriteKeyLocked(b *model.SnapshotBuilder, k model.TrieKey, cands map[string]model.TrieCandidate) {
+	owners := rm.owners[k]
+	if len(owners) == 0 {
+		delete(rm.owners, k)
+		delete(rm.conflicts, k)
+		b.DeleteTrieKey(k)
+		return
+	}
+	leaf := make([]model.TrieCandidate, 0, len(owners))
+	for _, id := range owners {
+		c, ok := cands[id]
+		if !ok {
+			var err error
+			if c, err = model.NewTrieCandidate(rm.store[id]); err != nil {
+				continue
+			}
+			cands[id] = c
+		}
+		leaf = append(leaf, c)
+	}
+	tl := model.NewTrieLeaf(leaf)
+	if c, ok := tl.Conflict(k); ok {
+		rm.conflicts[k] = c
+	} else {
+		delete(rm.conflicts, k)
+	}
+	b.SetTrieKey(k, tl)
+}
+
+// commitLocked version s, make it active, record it in history and notify the subscribers with ev.
+// ids and keys are the routes and trie keys changed since the previous revision, the first revision records every route.
+func (rm *RouterCoordinator) commitLocked(s *model.RouteSnapshot, ev SnapshotEvent, ids []string, keys map[model.TrieKey]struct{}) {
+	ev.Previous = rm.version
+	rm.version++
+	s.Version = rm.version
+	ev.Version = s.Version
+	rm.active.store(s)
+	rm.notifyLocked(ev)
+	rev := revision{
+		snapshot:  s,
+		published: time.Now(),
+		routes:    len(rm.store),
+		vhosts:    slices.Clone(rm.published),
+	}
+	if len(rm.history) == 0 {
+		active := routeSet{store: rm.store, hostOf: rm.hostOf, seq: rm.seq, conflicts: rm.conflicts}
+		rm.historyBase = active.clone()
+	} else {
+		rev.changed = make(map[string]routeState, len(ids))
+		for _, id := range ids {
+			if r, ok := rm.store[id]; ok {
+				rev.changed[id] = routeState{route: r, host: rm.hostOf[id], seq: rm.seq[id]}
+			} else {
+				rev.changed[id] = routeState{}
+			}
+		}
+		rev.conflicts = make(map[model.TrieKey]*model.Conflict, len(keys))
+		for k := range keys {
+			if c, ok := rm.conflicts[k]; ok {
+				rev.conflicts[k] = &c
+			} else {
+				rev.conflicts[k] = nil
+			}
+		}
+	}
+	rm.history = append(rm.history, rev)
+	rm.trimHistoryLocked()
+}
+
+// trimHistoryLocked drop the revisions beyond historyLimit, their changes are folded into historyBase
+func (rm *RouterCoordinator) trimHistoryLocked() {
+	n := len(rm.history) - rm.historyLimit
+	if n <= 0 {
+		return
+	}
+	for i := 1; i <= n; i++ {
+		rm.historyBase.apply(&rm.history[i])
+	}
+	rm.history[n].changed, rm.history[n].conflicts = nil, nil
+	clear(rm.history[:n]) // release the old snapshots
+	rm.history = rm.history[n:]
+}
+
+// validateLocked validate the changed routes, and the virtual hosts when they changed
+func (rm *RouterCoordinator) validateLocked() error {
+	var errs model.ValidationErrors
+	if rm.domainsDirty {
+		errs = model.ValidateVirtualHosts(rm.vhosts)
+	}
+	ids := slices.Sorted(maps.Keys(rm.dirty))
+	for _, id := range ids {
+		r, ok := rm.store[id]
+		if !ok {
+			continue
+		}
+		rerrs := model.ValidateRouter(r)
+		for _, e := range rerrs {
+			e.VirtualHost = rm.hostOf[id]
+		}
+		errs = append(errs, rerrs...)
+	}
+	return errs.Err()
+}
+
+// rejectLocked drop the pending changes, back to the routes and virtual hosts of the active snapshot
+func (rm *RouterCoordinator) rejectLocked() {
+	for id := range rm.dirty {
+		p, ok := rm.placed[id]
+		if !ok {
+			delete(rm.store, id)
+			delete(rm.seq, id)
+			delete(rm.hostOf, id)
+			continue
+		}
+		rm.store[id] = p.route
+		rm.seq[id] = p.seq
+		if p.host == model.DefaultHost {
+			delete(rm.hostOf, id)
+		} else {
+			rm.hostOf[id] = p.host
+		}
+	}
+	clear(rm.dirty)
+	clear(rm.swaps)
+	if rm.domainsDirty {
+		rm.vhosts = slices.Clone(rm.published)
+		rm.domainsDirty = false
+	}
 }
 
-func buildConfig(routes []*model.Router) *model.RouteConfiguration {
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// buildConfig the config of the first snapshot. Of the routes sharing an id only the last one is kept,
+// it replaces the earlier ones as OnAddRouter would.
+func buildConfig(routeConfig *model.RouteConfiguration) *model.RouteConfiguration {
 	cfg := &model.RouteConfiguration{
-		RouteTrie: trie.NewTrie(),
-		Routes:    make([]*model.Router, 0, len(routes)),
-		Dynamic:   false,
+		VirtualHosts: slices.Clone(routeConfig.VirtualHosts),
+		Dynamic:      false,
 	}
-	for _, r := range routes {
-		cfg.Routes = append(cfg.Routes, r)
+	// routes are counted in the order the snapshot takes them, the virtual hosts with a repeated name are not used
+	left := make(map[string]int, len(routeConfig.Routes))
+	for _, r := range routeConfig.Routes {
+		left[r.ID]++
+	}
+	var used []int
+	seen := make(map[string]struct{}, len(routeConfig.VirtualHosts))
+	for i, vh := range routeConfig.VirtualHosts {
+		if vh == nil || vh.Name == model.DefaultHost {
+			continue
+		}
+		if _, dup := seen[vh.Name]; dup {
+			continue
+		}
+		seen[vh.Name] = struct{}{}
+		used = append(used, i)
+		for _, r := range vh.Routes {
+			left[r.ID]++
+		}
+	}
+	last := func(routes []*model.Router) []*model.Router {
+		out := make([]*model.Router, 0, len(routes))
+		for _, r := range routes {
+			if left[r.ID]--; left[r.ID] == 0 {
+				out = append(out, r)
+			}
+		}
+		return out
+	}
+	cfg.Routes = last(routeConfig.Routes)
+	for _, i := range used {
+		if routes := last(cfg.VirtualHosts[i].Routes); len(routes) < len(cfg.VirtualHosts[i].Routes) {
+			vh := *cfg.VirtualHosts[i]
+			vh.Routes = routes
+			cfg.VirtualHosts[i] = &vh
+		}
 	}
 	initRegex(cfg)
-	fillTrieFromRoutes(cfg)
 	return cfg
 }
 
 func initRegex(cfg *model.RouteConfiguration) {
 	for _, router := range cfg.Routes {
-		headers := router.Match.Headers
-		for i := range headers {
-			if headers[i].Regex && len(headers[i].Values) > 0 {
-				if err := headers[i].SetValueRegex(headers[i].Values[0]); err != nil {
-					// todo use logger
-					fmt.Printf("invalid regexp in headers[%d]: %v", i, err)
-				}
-			}
+		initHeaderRegex(router)
+	}
+	for _, vh := range cfg.VirtualHosts {
+		if vh == nil {
+			continue
+		}
+		for _, router := range vh.Routes {
+			initHeaderRegex(router)
 		}
 	}
 }
 
-func fillTrieFromRoutes(cfg *model.RouteConfiguration) {
-	for _, r := range cfg.Routes {
-		methods := r.Match.Methods
-		if len(methods) == 0 {
-			methods = []string{"GET", "POST", "PUT", "DELETE", "PATCH", "OPTIONS", "HEAD"}
-		}
-		isPrefix := r.Match.Prefix != ""
-		for _, m := range methods {
-			key := util.GetTrieKeyWithPrefix(m, r.Match.Path, r.Match.Prefix, isPrefix)
-			_, _ = cfg.RouteTrie.Put(key, r.Route)
+func initHeaderRegex(router *model.Router) {
+	headers := router.Match.Headers
+	for i := range headers {
+		// an invalid regex is left enabled, the validation rejects the route instead of matching the header on presence only
+		if headers[i].Regex && len(headers[i].Values) > 0 && util.GetCachedRegexp(headers[i].Values[0]) != nil {
+			_ = headers[i].SetValueRegex(headers[i].Values[0])
 		}
 	}
 }
@@ -191,28 +1120,86 @@ type snapshotHolder struct {
 func (h *snapshotHolder) load() *model.RouteSnapshot   { return h.ptr.Load() }
 func (h *snapshotHolder) store(s *model.RouteSnapshot) { h.ptr.Store(s) }
 
-func matchHeaders(chs []model.CompiledHeader, r *http.Request) bool {
-	for _, ch := range chs {
-		val := r.Header.Get(ch.Name)
-		if val == "" {
-			return false
+// matchInput what the conditions beyond the path are evaluated on, req is nil for RouteByPathAndName
+type matchInput struct {
+	req      *http.Request
+	rawQuery string
+	query    url.Values // parsed from rawQuery on first use
+}
+
+// matches the request satisfies headers, query parameters and cookies, headers and cookies never match without a request
+func (in *matchInput) matches(headers []model.CompiledHeader, params []model.CompiledQueryParam, cookies []model.CompiledCookie) bool {
+	if len(headers) > 0 && (in.req == nil || !matchHeaders(headers, in.req)) {
+		return false
+	}
+	if len(cookies) > 0 && (in.req == nil || !matchCookies(cookies, in.req)) {
+		return false
+	}
+	if len(params) > 0 {
+		if in.query == nil {
+			in.query, _ = url.ParseQuery(in.rawQuery)
 		}
-		if ch.Regex != nil {
-			if !ch.Regex.MatchString(val) {
+		return matchQueryParams(params, in.query)
+	}
+	return true
+}
+
+func matchQueryParams(cqs []model.CompiledQueryParam, q url.Values) bool {
+	for _, cq := range cqs {
+		vals, ok := q[cq.Name]
+		if cq.Absent {
+			if ok {
 				return false
 			}
-		} else if len(ch.Values) > 0 {
-			ok := false
-			for _, v := range ch.Values {
-				if v == val {
-					ok = true
-					break
-				}
+			continue
+		}
+		if !ok {
+			return false
+		}
+		if cq.Regex == nil && len(cq.Values) == 0 {
+			continue
+		}
+		if !slices.ContainsFunc(vals, func(v string) bool {
+			if cq.Regex != nil {
+				return cq.Regex.MatchString(v)
+			}
+			return slices.Contains(cq.Values, v)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchCookies every cookie condition holds for the first cookie of its name
+func matchCookies(ccs []model.CompiledCookie, r *http.Request) bool {
+	for i := range ccs {
+		cc := &ccs[i]
+		c, err := r.Cookie(cc.Name)
+		if err != nil {
+			return false
+		}
+		switch {
+		case cc.Regex != nil:
+			if !cc.Regex.MatchString(c.Value) {
+				return false
 			}
-			if !ok {
+		case len(cc.Values) > 0:
+			if !slices.Contains(cc.Values, c.Value) {
 				return false
 			}
 		}
 	}
 	return true
 }
+
+func matchHeaders(chs []model.CompiledHeader, r *http.Request) bool {
+	for i := range chs {
+		ch := &chs[i]
+		// names are canonical, the header map is read as is
+		if !ch.Match(r.Header[ch.Name]) {
+			return false
+		}
+	}
+	return true
+}
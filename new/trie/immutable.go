@@ -0,0 +1,82 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package trie
+
+// ImmutableTrie is a persistent Trie: it is never modified once built.
+// Put, PutOrUpdate and Remove return a new ImmutableTrie which shares every unchanged Node
+// with the receiver, so any number of versions can coexist and be read without locks.
+type ImmutableTrie[T any] struct {
+	t Trie[T]
+}
+
+// NewImmutableTrie creates and returns an empty ImmutableTrie.
+func NewImmutableTrie[T any]() ImmutableTrie[T] {
+	return ImmutableTrie[T]{t: NewTrie[T]()}
+}
+
+// Put returns a new version with the path and its business info added.
+func (it ImmutableTrie[T]) Put(withOutHost string, bizInfo T) (ImmutableTrie[T], bool, error) {
+	t := it.Thaw()
+	ok, err := t.Put(withOutHost, bizInfo)
+	return t.Freeze(), ok, err
+}
+
+// PutOrUpdate returns a new version with the business info of the path replaced.
+func (it ImmutableTrie[T]) PutOrUpdate(withOutHost string, bizInfo T) (ImmutableTrie[T], bool, error) {
+	t := it.Thaw()
+	ok, err := t.PutOrUpdate(withOutHost, bizInfo)
+	return t.Freeze(), ok, err
+}
+
+// Remove returns a new version without the path.
+func (it ImmutableTrie[T]) Remove(withOutHost string) (ImmutableTrie[T], RemoveResult[T], error) {
+	t := it.Thaw()
+	res, err := t.Remove(withOutHost)
+	return t.Freeze(), res, err
+}
+
+// Thaw returns a mutable copy-on-write Trie sharing every node with it,
+// use it to apply a batch of changes and Freeze the result.
+func (it ImmutableTrie[T]) Thaw() Trie[T] {
+	return it.t.Fork()
+}
+
+// IsEmpty checks if the Trie is empty.
+func (it *ImmutableTrie[T]) IsEmpty() bool {
+	return it.t.IsEmpty()
+}
+
+// Get retrieves the business info for a path.
+func (it *ImmutableTrie[T]) Get(withOutHost string) (*Node[T], []string, bool, error) {
+	return it.t.Get(withOutHost)
+}
+
+// Match checks if the path matches any route in the Trie, returns the business info of the matched path.
+func (it *ImmutableTrie[T]) Match(withOutHost string) (T, []string, bool) {
+	return it.t.Match(withOutHost)
+}
+
+// MatchFunc like Match, nodes whose bizInfo is rejected by accept are skipped.
+func (it *ImmutableTrie[T]) MatchFunc(withOutHost string, accept func(bizInfo T) bool) (T, []string, bool) {
+	return it.t.MatchFunc(withOutHost, accept)
+}
+
+// Contains checks if a key exists in the Trie.
+func (it *ImmutableTrie[T]) Contains(withOutHost string) (bool, error) {
+	return it.t.Contains(withOutHost)
+}
@@ -0,0 +1,332 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package trie
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Radix is a read-only, path-compressed layout of an ImmutableTrie with the same Match semantics.
+// Chains of static segments without branch are collapsed in one edge, the edges of a node are laid out
+// as the sorted map of its static children and found by binary search, so matching walks no hash map.
+type Radix[T any] struct {
+	root *radixNode[T]
+}
+
+// radixNode the compiled version of src
+type radixNode[T any] struct {
+	src      *Node[T] // compiled node, its subtree is unchanged as long as the pointer is
+	edges    *radixEdges[T]
+	patterns []radixPattern[T] // in put order, tried before variable
+	variable *radixNode[T]
+	matchAll *radixNode[T] // only set when a path ends there
+	end      bool
+	bizInfo  T
+}
+
+// radixEdges the edges of the static children of a node, laid out as the node of their segMap src:
+// a leaf holds the edges of src.keys, an inner node the edges under each of src.kids
+type radixEdges[T any] struct {
+	src   *segNode[*Node[T]]
+	edges []radixEdge[T]
+	kids  []*radixEdges[T]
+}
+
+// radixEdge a chain of static segments, first/tail with segs segments in all
+type radixEdge[T any] struct {
+	first string
+	tail  string   // the segments after first joined by /, empty for a one segment edge
+	segs  int      // number of segments of the edge
+	head  *Node[T] // trie node of first, the chain is unchanged as long as the pointer is
+	node  *radixNode[T]
+}
+
+type radixPattern[T any] struct {
+	re   *regexp.Regexp
+	node *radixNode[T]
+}
+
+// CompileRadix lays it out as a Radix. Subtrees of prev whose trie nodes are shared with it are reused,
+// so compiling a new version of a trie costs in proportion of the paths changed since prev, which may be nil.
+func CompileRadix[T any](it *ImmutableTrie[T], prev *Radix[T]) *Radix[T] {
+	var old *radixNode[T]
+	if prev != nil {
+		old = prev.root
+	}
+	// the root is held by value and its address may be shared by versions, the copy is always compiled
+	root := it.t.root
+	return &Radix[T]{root: compileRadixNode(&root, old)}
+}
+
+// Match checks if the path matches any route, returns the business info of the matched path.
+func (r *Radix[T]) Match(withOutHost string) (T, []string, bool) {
+	return r.MatchFunc(withOutHost, nil)
+}
+
+// MatchFunc like Match, nodes whose bizInfo is rejected by accept are skipped.
+func (r *Radix[T]) MatchFunc(withOutHost string, accept func(bizInfo T) bool) (T, []string, bool) {
+	if i := strings.IndexByte(withOutHost, '?'); i >= 0 {
+		withOutHost = withOutHost[:i]
+	}
+	n, params, ok := r.root.match(strings.TrimLeft(withOutHost, "/"), accept, nil)
+	if !ok {
+		var zero T
+		return zero, nil, false
+	}
+	return n.bizInfo, params, true
+}
+
+// MatchAppend like MatchFunc on the path first + "/" + rest, or on first alone when more is false, without building it.
+// Path variable values are appended to params, so matching allocates nothing when params has room for them.
+func (r *Radix[T]) MatchAppend(first, rest string, more bool, accept func(bizInfo T) bool, params []string) (T, []string, bool) {
+	n, params, ok := r.root.matchSegment(first, rest, !more, accept, params)
+	if !ok {
+		var zero T
+		return zero, params, false
+	}
+	return n.bizInfo, params, true
+}
+
+func compileRadixNode[T any](n *Node[T], old *radixNode[T]) *radixNode[T] {
+	if old != nil && old.src == n {
+		return old
+	}
+	rn := &radixNode[T]{src: n, end: n.endOfPath, bizInfo: n.bizInfo}
+	rn.edges = compileRadixEdges(n, old)
+	if len(n.PatternNodes) > 0 {
+		rn.patterns = make([]radixPattern[T], 0, len(n.PatternNodes))
+		for _, pn := range n.PatternNodes {
+			var prev *radixNode[T]
+			if old != nil {
+				if i := slices.IndexFunc(old.patterns, func(p radixPattern[T]) bool { return p.re == pn.pattern }); i >= 0 {
+					prev = old.patterns[i].node
+				}
+			}
+			rn.patterns = append(rn.patterns, radixPattern[T]{re: pn.pattern, node: compileRadixNode(pn, prev)})
+		}
+	}
+	if n.PathVariableNode != nil {
+		var prev *radixNode[T]
+		if old != nil {
+			prev = old.variable
+		}
+		rn.variable = compileRadixNode(n.PathVariableNode, prev)
+	}
+	if n.MatchAllNode != nil && n.MatchAllNode.endOfPath {
+		var prev *radixNode[T]
+		if old != nil {
+			prev = old.matchAll
+		}
+		rn.matchAll = compileRadixNode(n.MatchAllNode, prev)
+	}
+	return rn
+}
+
+// compileRadixEdges the edges of the static children of n, the parts of their map shared with the children
+// of old.src keep their edges, so a change under a node with many children compiles O(log n) edges
+func compileRadixEdges[T any](n *Node[T], old *radixNode[T]) *radixEdges[T] {
+	if n.children.root == nil {
+		return nil
+	}
+	var prev *radixEdges[T]
+	if old != nil {
+		prev = old.edges
+	}
+	return compileRadixEdgeNode(n.children.root, prev.mirror(n.children.root), prev)
+}
+
+// compileRadixEdgeNode the mirror of src, at is the mirror src had in old, if any
+func compileRadixEdgeNode[T any](src *segNode[*Node[T]], at, old *radixEdges[T]) *radixEdges[T] {
+	if at != nil {
+		return at
+	}
+	es := &radixEdges[T]{src: src}
+	if src.kids == nil {
+		es.edges = make([]radixEdge[T], len(src.keys))
+		for i, key := range src.keys {
+			switch prev := old.find(key); {
+			case prev != nil && prev.head == src.vals[i]:
+				es.edges[i] = *prev
+			default:
+				es.edges[i] = compileRadixEdge(key, src.vals[i], prev)
+			}
+		}
+		return es
+	}
+	es.kids = make([]*radixEdges[T], len(src.kids))
+	for i, kid := range src.kids {
+		es.kids[i] = compileRadixEdgeNode(kid, old.mirror(kid), old)
+	}
+	return es
+}
+
+// compileRadixEdge follow the chain of static nodes starting at head
+func compileRadixEdge[T any](first string, head *Node[T], old *radixEdge[T]) radixEdge[T] {
+	e := radixEdge[T]{first: first, segs: 1, head: head}
+	var tail []string
+	end := head
+	for !end.endOfPath && end.children.len() == 1 && len(end.PatternNodes) == 0 &&
+		end.PathVariableNode == nil && end.MatchAllNode == nil {
+		for key, c := range end.children.all() {
+			tail = append(tail, key)
+			end = c
+		}
+	}
+	e.segs += len(tail)
+	e.tail = strings.Join(tail, "/")
+	var prev *radixNode[T]
+	if old != nil && old.segs == e.segs && old.tail == e.tail {
+		prev = old.node
+	}
+	e.node = compileRadixNode(end, prev)
+	return e
+}
+
+// edge the edge starting with first, nil if there is none
+func (n *radixNode[T]) edge(first string) *radixEdge[T] {
+	return n.edges.find(first)
+}
+
+// find the edge starting with first
+func (es *radixEdges[T]) find(first string) *radixEdge[T] {
+	for es != nil && es.kids != nil {
+		i, found := slices.BinarySearch(es.src.keys, first)
+		if !found {
+			i--
+		}
+		if i < 0 {
+			return nil
+		}
+		es = es.kids[i]
+	}
+	if es == nil {
+		return nil
+	}
+	i, ok := slices.BinarySearch(es.src.keys, first)
+	if !ok {
+		return nil
+	}
+	return &es.edges[i]
+}
+
+// mirror the node of es compiled from src, nil if src is not a node of the map es was compiled from
+func (es *radixEdges[T]) mirror(src *segNode[*Node[T]]) *radixEdges[T] {
+	first := src.keys[0]
+	for es != nil && es.src != src && es.kids != nil {
+		i, found := slices.BinarySearch(es.src.keys, first)
+		if !found {
+			i--
+		}
+		if i < 0 {
+			return nil
+		}
+		es = es.kids[i]
+	}
+	if es == nil || es.src != src {
+		return nil
+	}
+	return es
+}
+
+// accepted a real path ends at n and accept agrees with its bizInfo
+func (n *radixNode[T]) accepted(accept func(bizInfo T) bool) bool {
+	return n.end && (accept == nil || accept(n.bizInfo))
+}
+
+// match follows Node.match: static child, pattern nodes, variable node, then the match all node of the static child
+// and the one of n. Path variable values are appended to params in path order.
+func (n *radixNode[T]) match(path string, accept func(bizInfo T) bool, params []string) (*radixNode[T], []string, bool) {
+	seg, rest, last := cutSegment(path)
+	return n.matchSegment(seg, rest, last, accept, params)
+}
+
+// matchSegment match seg, the path continues with rest unless seg is the last segment
+func (n *radixNode[T]) matchSegment(seg, rest string, last bool, accept func(bizInfo T) bool, params []string) (*radixNode[T], []string, bool) {
+	// the node of a one segment edge, its match all node is tried after the variables as Node.match does
+	var child *radixNode[T]
+	if e := n.edge(seg); e != nil {
+		if e.segs == 1 {
+			child = e.node
+			if last {
+				if child.accepted(accept) {
+					return child, params, true
+				}
+			} else if m, p, ok := child.match(rest, accept, params); ok {
+				return m, p, true
+			}
+		} else if !last && strings.HasPrefix(rest, e.tail) {
+			// the nodes inside the edge have nothing but the next segment, only its last node can match
+			switch after := rest[len(e.tail):]; {
+			case after == "":
+				if e.node.accepted(accept) {
+					return e.node, params, true
+				}
+				if m := e.node.matchAll; m != nil && m.accepted(accept) {
+					return m, params, true
+				}
+			case after[0] == '/':
+				if m, p, ok := e.node.match(after[1:], accept, params); ok {
+					return m, p, true
+				}
+				if m := e.node.matchAll; m != nil && m.accepted(accept) {
+					return m, params, true
+				}
+			}
+		}
+	}
+	for i := range n.patterns {
+		pn := &n.patterns[i]
+		if !pn.re.MatchString(seg) {
+			continue
+		}
+		if last {
+			if pn.node.accepted(accept) {
+				return pn.node, append(params, seg), true
+			}
+		} else if m, p, ok := pn.node.match(rest, accept, append(params, seg)); ok {
+			return m, p, true
+		}
+	}
+	if v := n.variable; v != nil {
+		if last {
+			if v.accepted(accept) {
+				return v, append(params, seg), true
+			}
+		} else if m, p, ok := v.match(rest, accept, append(params, seg)); ok {
+			return m, p, true
+		}
+	}
+	if child != nil && child.matchAll != nil && child.matchAll.accepted(accept) {
+		return child.matchAll, params, true
+	}
+	if n.matchAll != nil && n.matchAll.accepted(accept) {
+		return n.matchAll, params, true
+	}
+	return nil, params, false
+}
+
+// cutSegment split the first segment of path off, last when path has no other segment
+func cutSegment(path string) (seg, rest string, last bool) {
+	i := strings.IndexByte(path, '/')
+	if i < 0 {
+		return path, "", true
+	}
+	return path[:i], path[i+1:], false
+}
@@ -0,0 +1,206 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package trie
+
+import (
+	"iter"
+	"slices"
+)
+
+// segMaxEntries the number of entries or children above which a segNode is split
+const segMaxEntries = 32
+
+// segMap a persistent map from a static path segment to V, a B+ tree sorted by segment.
+// Versions share their nodes, a change copies the nodes on the way to its leaf unless tok owns them,
+// so it costs O(log n) whatever the number of entries. The zero value is an empty map.
+type segMap[V any] struct {
+	root *segNode[V]
+	n    int
+}
+
+// segNode a leaf holds keys and vals, an inner node keys and kids, keys[i] being the smallest key under kids[i].
+// Nodes are never empty, a node emptied by a delete is unlinked, nodes are not merged.
+type segNode[V any] struct {
+	keys  []string
+	vals  []V
+	kids  []*segNode[V]
+	owner *editToken
+}
+
+// len the number of entries
+func (m *segMap[V]) len() int {
+	return m.n
+}
+
+// get the value of key
+func (m *segMap[V]) get(key string) (V, bool) {
+	n := m.root
+	for n != nil {
+		i, found := slices.BinarySearch(n.keys, key)
+		if n.kids == nil {
+			if found {
+				return n.vals[i], true
+			}
+			break
+		}
+		if !found {
+			i--
+		}
+		if i < 0 {
+			break
+		}
+		n = n.kids[i]
+	}
+	var zero V
+	return zero, false
+}
+
+// set key to v
+func (m *segMap[V]) set(key string, v V, tok *editToken) {
+	if m.root == nil {
+		m.root = &segNode[V]{keys: []string{key}, vals: []V{v}, owner: tok}
+		m.n = 1
+		return
+	}
+	root := m.root.editable(tok)
+	if root.set(key, v, tok) {
+		m.n++
+	}
+	if len(root.keys) > segMaxEntries {
+		right := root.split(tok)
+		root = &segNode[V]{keys: []string{root.keys[0], right.keys[0]}, kids: []*segNode[V]{root, right}, owner: tok}
+	}
+	m.root = root
+}
+
+// delete key, nothing is copied when it is absent
+func (m *segMap[V]) delete(key string, tok *editToken) {
+	if _, ok := m.get(key); !ok {
+		return
+	}
+	root := m.root.editable(tok)
+	root.delete(key, tok)
+	m.n--
+	for root.kids != nil && len(root.kids) == 1 {
+		root = root.kids[0]
+	}
+	if len(root.keys) == 0 {
+		root = nil
+	}
+	m.root = root
+}
+
+// all the entries in key order
+func (m *segMap[V]) all() iter.Seq2[string, V] {
+	return func(yield func(string, V) bool) {
+		m.root.each(yield)
+	}
+}
+
+func (n *segNode[V]) each(yield func(string, V) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.kids == nil {
+		for i, key := range n.keys {
+			if !yield(key, n.vals[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, kid := range n.kids {
+		if !kid.each(yield) {
+			return false
+		}
+	}
+	return true
+}
+
+// editable returns n itself if it is owned by tok, otherwise a copy of it owned by tok
+func (n *segNode[V]) editable(tok *editToken) *segNode[V] {
+	if n.owner == tok {
+		return n
+	}
+	return &segNode[V]{keys: slices.Clone(n.keys), vals: slices.Clone(n.vals), kids: slices.Clone(n.kids), owner: tok}
+}
+
+// set key to v under n, which must be editable, reports whether key was added
+func (n *segNode[V]) set(key string, v V, tok *editToken) bool {
+	i, found := slices.BinarySearch(n.keys, key)
+	if n.kids == nil {
+		if found {
+			n.vals[i] = v
+			return false
+		}
+		n.keys = slices.Insert(n.keys, i, key)
+		n.vals = slices.Insert(n.vals, i, v)
+		return true
+	}
+	if !found {
+		i = max(i-1, 0)
+	}
+	kid := n.kids[i].editable(tok)
+	added := kid.set(key, v, tok)
+	n.kids[i], n.keys[i] = kid, kid.keys[0]
+	if len(kid.keys) > segMaxEntries {
+		right := kid.split(tok)
+		n.keys = slices.Insert(n.keys, i+1, right.keys[0])
+		n.kids = slices.Insert(n.kids, i+1, right)
+	}
+	return added
+}
+
+// delete key under n, which must be editable, the key must exist
+func (n *segNode[V]) delete(key string, tok *editToken) {
+	i, found := slices.BinarySearch(n.keys, key)
+	if n.kids == nil {
+		n.keys = slices.Delete(n.keys, i, i+1)
+		n.vals = slices.Delete(n.vals, i, i+1)
+		return
+	}
+	if !found {
+		i--
+	}
+	kid := n.kids[i].editable(tok)
+	kid.delete(key, tok)
+	if len(kid.keys) == 0 {
+		n.keys = slices.Delete(n.keys, i, i+1)
+		n.kids = slices.Delete(n.kids, i, i+1)
+		return
+	}
+	n.kids[i], n.keys[i] = kid, kid.keys[0]
+}
+
+// split moves the upper half of n to a new node, returns it
+func (n *segNode[V]) split(tok *editToken) *segNode[V] {
+	h := len(n.keys) / 2
+	right := &segNode[V]{keys: slices.Clone(n.keys[h:]), owner: tok}
+	clear(n.keys[h:])
+	n.keys = n.keys[:h]
+	if n.kids == nil {
+		right.vals = slices.Clone(n.vals[h:])
+		clear(n.vals[h:])
+		n.vals = n.vals[:h]
+	} else {
+		right.kids = slices.Clone(n.kids[h:])
+		clear(n.kids[h:])
+		n.kids = n.kids[:h]
+	}
+	return right
+}
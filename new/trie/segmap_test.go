@@ -0,0 +1,127 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package trie
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegMap_VersionsShareUntouchedNodes(t *testing.T) {
+	tok := &editToken{}
+	var m segMap[int]
+	keys := rand.New(rand.NewSource(1)).Perm(1000)
+	for _, k := range keys {
+		m.set(strconv.Itoa(k), k, tok)
+	}
+	assert.Equal(t, 1000, m.len())
+	prev, n := "", 0
+	for key, v := range m.all() {
+		assert.Less(t, prev, key)
+		assert.Equal(t, strconv.Itoa(v), key)
+		prev = key
+		n++
+	}
+	assert.Equal(t, 1000, n)
+
+	// a version changed under another token leaves m alone
+	next := m
+	tok2 := &editToken{}
+	next.set("500", -1, tok2)
+	next.delete("7", tok2)
+	next.delete("missing", tok2)
+	v, _ := m.get("500")
+	assert.Equal(t, 500, v)
+	v, _ = next.get("500")
+	assert.Equal(t, -1, v)
+	_, ok := m.get("7")
+	assert.True(t, ok)
+	_, ok = next.get("7")
+	assert.False(t, ok)
+	assert.Equal(t, 1000, m.len())
+	assert.Equal(t, 999, next.len())
+
+	// only the nodes on the way to the changed keys are copied
+	old := map[*segNode[int]]bool{}
+	for _, sn := range segNodes(m.root) {
+		old[sn] = true
+	}
+	all := segNodes(next.root)
+	fresh := 0
+	for _, sn := range all {
+		if !old[sn] {
+			fresh++
+		}
+	}
+	assert.Greater(t, len(all), 30)
+	assert.LessOrEqual(t, fresh, 6)
+
+	for _, k := range keys {
+		next.delete(strconv.Itoa(k), tok2)
+	}
+	assert.Zero(t, next.len())
+	assert.Nil(t, next.root)
+	v, _ = m.get("999")
+	assert.Equal(t, 999, v)
+}
+
+// segNodes n and the nodes below it
+func segNodes[V any](n *segNode[V]) []*segNode[V] {
+	out := []*segNode[V]{n}
+	for _, kid := range n.kids {
+		out = append(out, segNodes(kid)...)
+	}
+	return out
+}
+
+// BenchmarkTrie_WideNodeChange one route changed under a node with fanOut static siblings,
+// the children of a node are a persistent map so the cost grows with log(fanOut), not with fanOut.
+func BenchmarkTrie_WideNodeChange(b *testing.B) {
+	for _, fanOut := range []int{100, 10_000, 100_000} {
+		base := NewTrie[int]()
+		for i := 0; i < fanOut; i++ {
+			_, _ = base.Put("/api/v1/item/"+strconv.Itoa(i), i)
+		}
+		it := base.Freeze()
+		rx := CompileRadix(&it, nil)
+		key := "/api/v1/item/" + strconv.Itoa(fanOut/2)
+
+		b.Run("trie/fanout-"+strconv.Itoa(fanOut), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				t := it.Thaw()
+				_, _ = t.PutOrUpdate(key, i)
+				_ = t.Freeze()
+			}
+		})
+		b.Run("trie+radix/fanout-"+strconv.Itoa(fanOut), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				t := it.Thaw()
+				_, _ = t.PutOrUpdate(key, i)
+				next := t.Freeze()
+				_ = CompileRadix(&next, rx)
+			}
+		})
+	}
+}
@@ -18,7 +18,10 @@
 package trie
 
 import (
-	"fmt"
+	"maps"
+	"reflect"
+	"regexp"
+	"slices"
 	"strings"
 )
 
@@ -30,67 +33,117 @@ import (
 	utils "github.com/alanxtl/pixiu-router-update/utils"
 )
 
-// Trie represents the Trie structure with the root node.
-type Trie struct {
-	root Node
+// Trie represents the Trie structure with the root node, T is the business info stored with each path.
+type Trie[T any] struct {
+	root  Node[T]
+	token *editToken // nodes owned by token may be modified in place, others are copied first
+}
+
+// editToken marks the nodes a Trie is allowed to modify in place.
+type editToken struct {
+	_ byte // non zero size, so that every token has its own address
 }
 
 // NewTrie creates and returns a new Trie.
-func NewTrie() Trie {
-	return Trie{root: Node{endOfPath: false, matchStr: ""}}
+func NewTrie[T any]() Trie[T] {
+	return Trie[T]{root: Node[T]{endOfPath: false, matchStr: ""}}
 }
 
 // NewTrieWithDefault creates a new Trie with a default path and value.
-func NewTrieWithDefault(path string, defVal any) Trie {
-	ret := Trie{root: Node{endOfPath: false, matchStr: ""}}
+func NewTrieWithDefault[T any](path string, defVal T) Trie[T] {
+	ret := Trie[T]{root: Node[T]{endOfPath: false, matchStr: ""}}
 	_, _ = ret.Put(path, defVal)
 	return ret
 }
 
 // Node represents each node in the Trie.
-type Node struct {
-	matchStr         string           // abc match abc, :a match all words as a variable names a , * match all words  ,** match all words and children.
-	children         map[string]*Node // in path /a/b/c  , b is child of a , c is child of b
-	PathVariablesSet map[string]*Node // in path /:a/b/c/:d , :a is a path variable node of level1 , :d is path variable node of level4
-	PathVariableNode *Node            // in path /:a/b/c/:d , /b/c/:d is a child tree of pathVariable node :a ,and some special logic for match pathVariable it better not store in children.
-	MatchAllNode     *Node            // /a/b/**  /** is a match all Node.
-	endOfPath        bool             // if true means a real path exists ,  /a/b/c/d only node of d is true, a,b,c is false.
-	bizInfo          any              // route info and any other info store here.
+type Node[T any] struct {
+	matchStr         string              // abc match abc, :a match all words as a variable names a , * match all words  ,** match all words and children.
+	children         segMap[*Node[T]]    // in path /a/b/c  , b is child of a , c is child of b
+	PathVariablesSet map[string]*Node[T] // in path /:a/b/c/:d , :a is a path variable node of level1 , :d is path variable node of level4
+	varPaths         map[string]int      // number of paths put through PathVariableNode under each name of PathVariablesSet
+	PathVariableNode *Node[T]            // in path /:a/b/c/:d , /b/c/:d is a child tree of pathVariable node :a ,and some special logic for match pathVariable it better not store in children.
+	PatternNodes     []*Node[T]          // in path /:id(\d+) , :id(\d+) is a pattern node, pattern nodes are tried in put order before PathVariableNode.
+	MatchAllNode     *Node[T]            // /a/b/**  /** is a match all Node.
+	pattern          *regexp.Regexp      // constraint of a pattern node, matches a whole segment.
+	endOfPath        bool                // if true means a real path exists ,  /a/b/c/d only node of d is true, a,b,c is false.
+	bizInfo          T                   // route info and any other info store here.
+	owner            *editToken          // the trie version which created this node
+}
+
+// Fork returns a copy-on-write copy of the Trie. The copy shares every node with trie,
+// a node is only copied the first time Put, PutOrUpdate or Remove touches it,
+// so the cost of a fork is proportional to the paths changed afterwards, see editable.
+// Both tries may be modified independently after the fork.
+func (trie *Trie[T]) Fork() Trie[T] {
+	trie.token = &editToken{}
+	tok := &editToken{}
+	return Trie[T]{root: *trie.root.editable(tok), token: tok}
+}
+
+// Freeze returns an immutable version of the Trie sharing every node with trie.
+// trie stays usable, its later changes copy the touched nodes and are not seen by the frozen version.
+func (trie *Trie[T]) Freeze() ImmutableTrie[T] {
+	frozen := ImmutableTrie[T]{t: Trie[T]{root: trie.root}}
+	trie.token = &editToken{}
+	return frozen
+}
+
+// editRoot makes the root node editable before a change.
+func (trie *Trie[T]) editRoot() {
+	if trie.root.owner != trie.token {
+		trie.root = *trie.root.editable(trie.token)
+	}
 }
 
 // Clear resets the Trie to its initial state.
-func (trie *Trie) Clear() bool {
+func (trie *Trie[T]) Clear() bool {
 	return trie.root.Clear()
 }
 
 // IsEmpty checks if the Trie is empty.
-func (trie *Trie) IsEmpty() bool {
+func (trie *Trie[T]) IsEmpty() bool {
 	return trie.root.IsEmpty()
 }
 
 // Put adds a path and associated business information to the Trie.
-func (trie *Trie) Put(withOutHost string, bizInfo any) (bool, error) {
-	if bizInfo == nil {
+func (trie *Trie[T]) Put(withOutHost string, bizInfo T) (bool, error) {
+	if isNil(bizInfo) {
 		return false, errors.Errorf("data to put should not be nil.")
 	}
 	parts := utils.Split(withOutHost)
-	return trie.root.internalPut(parts, bizInfo)
+	if err := checkConstraints(parts); err != nil {
+		return false, err
+	}
+	trie.editRoot()
+	return trie.root.internalPut(parts, bizInfo, trie.token)
 }
 
 // PutOrUpdate updates a path and its business info in the Trie.
-func (trie *Trie) PutOrUpdate(withOutHost string, bizInfo any) (bool, error) {
-	if bizInfo == nil {
+// An existing path keeps its nodes, only its business info is replaced.
+func (trie *Trie[T]) PutOrUpdate(withOutHost string, bizInfo T) (bool, error) {
+	if isNil(bizInfo) {
 		return false, errors.Errorf("data to put should not be nil.")
 	}
 	parts := utils.Split(withOutHost)
-	if _, err := trie.Remove(withOutHost); err != nil {
-		fmt.Printf("PutOrUpdate failed for %s: %v", withOutHost, err)
+	if err := checkConstraints(parts); err != nil {
+		return false, err
 	}
-	return trie.root.internalPut(parts, bizInfo)
+	if n, _, _, err := trie.root.Get(parts); err == nil && n != nil && n.endOfPath {
+		trie.editRoot()
+		n = trie.root.editPath(parts, trie.token)
+		n.bizInfo = bizInfo
+		if last := parts[len(parts)-1]; utils.IsPathVariableOrWildcard(last) {
+			n.matchStr, _ = utils.VariableConstraint(last)
+		}
+		return true, nil
+	}
+	trie.editRoot()
+	return trie.root.internalPut(parts, bizInfo, trie.token)
 }
 
 // Get retrieves the business info for a path.
-func (trie *Trie) Get(withOutHost string) (*Node, []string, bool, error) {
+func (trie *Trie[T]) Get(withOutHost string) (*Node[T], []string, bool, error) {
 	parts := utils.Split(withOutHost)
 	node, param, ok, e := trie.root.Get(parts)
 	length := len(param)
@@ -102,34 +155,53 @@ func (trie *Trie) Get(withOutHost string) (*Node, []string, bool, error) {
 	return node, param, ok, e
 }
 
-// Match checks if the path matches any route in the Trie.
-func (trie *Trie) Match(withOutHost string) (*Node, []string, bool) {
+// Match checks if the path matches any route in the Trie, returns the business info of the matched path.
+func (trie *Trie[T]) Match(withOutHost string) (T, []string, bool) {
+	return trie.MatchFunc(withOutHost, nil)
+}
+
+// MatchFunc like Match, a node only matches when accept returns true for its bizInfo,
+// otherwise matching goes on with the next candidate node (variable, wildcard, ...). nil accepts any node.
+func (trie *Trie[T]) MatchFunc(withOutHost string, accept func(bizInfo T) bool) (T, []string, bool) {
 	withOutHost = strings.Split(withOutHost, "?")[0]
 	parts := utils.Split(withOutHost)
-	node, param, ok := trie.root.Match(parts)
+	node, param, ok := trie.root.match(parts, accept)
+	if !ok {
+		var zero T
+		return zero, nil, false
+	}
 	length := len(param)
 	for i := 0; i < length/2; i++ {
 		temp := param[length-1-i]
 		param[length-1-i] = param[i]
 		param[i] = temp
 	}
-	return node, param, ok
+	return node.bizInfo, param, true
 }
 
-// Remove removes a path from the Trie.
-func (trie *Trie) Remove(withOutHost string) (*Node, error) {
-	n, _, _, e := trie.Get(withOutHost)
-	if e != nil {
-		return nil, e
-	}
-	if n != nil {
-		n.endOfPath = false
+// RemoveResult the outcome of Trie.Remove
+type RemoveResult[T any] struct {
+	Removed bool // the path existed
+	BizInfo T    // business info of the removed path
+	Pruned  int  // nodes left without path nor children, unlinked from the trie
+}
+
+// Remove removes a path from the Trie, and the nodes only this path needed.
+// Nothing is copied when the path does not exist.
+func (trie *Trie[T]) Remove(withOutHost string) (RemoveResult[T], error) {
+	parts := utils.Split(withOutHost)
+	n, _, _, err := trie.root.Get(parts)
+	if err != nil || n == nil || !n.endOfPath {
+		return RemoveResult[T]{}, err
 	}
-	return n, nil
+	trie.editRoot()
+	var res RemoveResult[T]
+	trie.root.internalRemove(parts, trie.token, &res)
+	return res, nil
 }
 
 // Contains checks if a key exists in the Trie.
-func (trie *Trie) Contains(withOutHost string) (bool, error) {
+func (trie *Trie[T]) Contains(withOutHost string) (bool, error) {
 	parts := utils.Split(withOutHost)
 	ret, _, _, e := trie.root.Get(parts)
 	if e != nil {
@@ -138,12 +210,33 @@ func (trie *Trie) Contains(withOutHost string) (bool, error) {
 	return !(ret == nil), nil
 }
 
-// internalPut is the internal logic to put a key and its bizInfo in the Trie
-func (node *Node) internalPut(keys []string, bizInfo any) (bool, error) {
-	// 初始化子节点
-	if node.children == nil {
-		node.children = make(map[string]*Node)
+// isNil v is nil, or a nil pointer, map, slice, func or chan held by T
+func isNil[T any](v T) bool {
+	if any(v) == nil {
+		return true
+	}
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// checkConstraints make sure every regex constraint of the path variables compiles
+func checkConstraints(parts []string) error {
+	for _, key := range parts {
+		if !utils.IsPathVariableOrWildcard(key) {
+			continue
+		}
+		if _, constraint := utils.VariableConstraint(key); constraint != "" && utils.GetCachedAnchoredRegexp(constraint) == nil {
+			return errors.Errorf("invalid regex constraint in path variable %s", key)
+		}
 	}
+	return nil
+}
+
+// internalPut is the internal logic to put a key and its bizInfo in the Trie
+func (node *Node[T]) internalPut(keys []string, bizInfo T, tok *editToken) (bool, error) {
 	if len(keys) == 0 {
 		return true, nil
 	}
@@ -152,7 +245,7 @@ func (node *Node) internalPut(keys []string, bizInfo any) (bool, error) {
 	// isReal is the end of url path, means node is a place of url end,
 	// so the path with parentNode has a real url exists.
 	isReal := len(keys) == 1
-	isSuccess := node.put(key, isReal, bizInfo)
+	isSuccess := node.put(key, isReal, bizInfo, tok)
 
 	if !isSuccess {
 		return false, nil
@@ -161,70 +254,258 @@ func (node *Node) internalPut(keys []string, bizInfo any) (bool, error) {
 
 	// 如果是路径变量或通配符路径
 	if utils.IsPathVariableOrWildcard(key) {
-		return node.PathVariableNode.internalPut(childKeys, bizInfo)
+		name, constraint := utils.VariableConstraint(key)
+		if constraint != "" {
+			_, pn := node.patternNode(constraint)
+			return pn.internalPut(childKeys, bizInfo, tok)
+		}
+		ok, err := node.PathVariableNode.internalPut(childKeys, bizInfo, tok)
+		if ok {
+			node.countVariable(name, 1)
+		} else {
+			node.countVariable(name, 0)
+		}
+		return ok, err
 	} else if utils.IsMatchAll(key) {
 		return isSuccess, nil
 	} else {
-		return node.children[key].internalPut(childKeys, bizInfo)
+		return node.child(key).internalPut(childKeys, bizInfo, tok)
 	}
 }
 
-func (node *Node) Clear() bool {
-	*node = Node{}
-	return true
+// internalRemove clears the end of path mark and bizInfo of the node addressed by keys,
+// then unlinks the nodes of the path left without path nor children, from the bottom up.
+// The path must exist, every node on the way is made editable first.
+func (node *Node[T]) internalRemove(keys []string, tok *editToken, res *RemoveResult[T]) {
+	next := node.editChild(keys[0], tok)
+	if len(keys) == 1 {
+		var zero T
+		res.Removed, res.BizInfo = true, next.bizInfo
+		next.endOfPath = false
+		next.bizInfo = zero
+		if utils.IsPathVariableOrWildcard(keys[0]) {
+			next.matchStr = ""
+		}
+	} else {
+		next.internalRemove(keys[1:], tok, res)
+	}
+	if name, constraint := utils.VariableConstraint(keys[0]); utils.IsPathVariableOrWildcard(keys[0]) && constraint == "" {
+		node.countVariable(name, -1)
+	}
+	if next.prunable() {
+		node.unlinkChild(keys[0], tok)
+		res.Pruned++
+	}
 }
 
-// IsEmpty return true if empty
-func (node *Node) IsEmpty() bool {
-	if node.children == nil && node.matchStr == "" && node.PathVariableNode == nil && node.PathVariablesSet == nil {
-		return true
+// editPath makes every node of the existing path addressed by keys editable, returns the last one
+func (node *Node[T]) editPath(keys []string, tok *editToken) *Node[T] {
+	next := node.editChild(keys[0], tok)
+	if len(keys) == 1 {
+		return next
+	}
+	return next.editPath(keys[1:], tok)
+}
+
+// editChild makes the child addressed by key editable, nil if there is none
+func (node *Node[T]) editChild(key string, tok *editToken) *Node[T] {
+	switch {
+	case utils.IsPathVariableOrWildcard(key):
+		if _, constraint := utils.VariableConstraint(key); constraint != "" {
+			i, pn := node.patternNode(constraint)
+			if pn == nil {
+				return nil
+			}
+			node.PatternNodes[i] = pn.editable(tok)
+			return node.PatternNodes[i]
+		}
+		if node.PathVariableNode == nil {
+			return nil
+		}
+		return node.editPathVariableNode(tok)
+	case utils.IsMatchAll(key):
+		if node.MatchAllNode == nil {
+			return nil
+		}
+		node.MatchAllNode = node.MatchAllNode.editable(tok)
+		return node.MatchAllNode
+	default:
+		c := node.child(key)
+		if c == nil {
+			return nil
+		}
+		if e := c.editable(tok); e != c {
+			node.children.set(key, e, tok)
+			c = e
+		}
+		return c
+	}
+}
+
+// unlinkChild drops the child addressed by key, node must be editable
+func (node *Node[T]) unlinkChild(key string, tok *editToken) {
+	switch {
+	case utils.IsPathVariableOrWildcard(key):
+		if _, constraint := utils.VariableConstraint(key); constraint != "" {
+			if i, _ := node.patternNode(constraint); i >= 0 {
+				node.PatternNodes = slices.Delete(node.PatternNodes, i, i+1)
+			}
+			if len(node.PatternNodes) == 0 {
+				node.PatternNodes = nil
+			}
+			return
+		}
+		node.PathVariableNode = nil
+		node.PathVariablesSet = nil
+		node.varPaths = nil
+	case utils.IsMatchAll(key):
+		node.MatchAllNode = nil
+	default:
+		node.children.delete(key, tok)
 	}
-	return false
+}
+
+// prunable no path ends at the node nor below it
+func (node *Node[T]) prunable() bool {
+	return !node.endOfPath && node.children.len() == 0 && node.PathVariableNode == nil &&
+		len(node.PatternNodes) == 0 && node.MatchAllNode == nil
+}
+
+// editable returns node itself if it is owned by tok, otherwise a copy of it owned by tok.
+// The static children are a persistent map shared with the copy, only the nodes of the map a change goes through
+// are copied later, so a node with many static siblings (/api/item/<id> for 100k ids) costs O(log n) to change.
+func (node *Node[T]) editable(tok *editToken) *Node[T] {
+	if node.owner == tok {
+		return node
+	}
+	cp := *node
+	cp.owner = tok
+	cp.PathVariablesSet = maps.Clone(node.PathVariablesSet)
+	cp.varPaths = maps.Clone(node.varPaths)
+	cp.PatternNodes = slices.Clone(node.PatternNodes)
+	return &cp
+}
+
+// child the static child named key, nil if there is none
+func (node *Node[T]) child(key string) *Node[T] {
+	c, _ := node.children.get(key)
+	return c
+}
+
+// patternNode find the pattern node with the constraint, returns its index in PatternNodes
+func (node *Node[T]) patternNode(constraint string) (int, *Node[T]) {
+	re := utils.GetCachedAnchoredRegexp(constraint)
+	for i, pn := range node.PatternNodes {
+		if pn.pattern == re {
+			return i, pn
+		}
+	}
+	return -1, nil
+}
+
+// countVariable add n to the paths put through PathVariableNode under name, node must be editable.
+// A name no path goes through any more is dropped from PathVariablesSet.
+func (node *Node[T]) countVariable(name string, n int) {
+	if node.varPaths == nil {
+		node.varPaths = map[string]int{}
+	}
+	if node.varPaths[name] += n; node.varPaths[name] <= 0 {
+		delete(node.varPaths, name)
+		delete(node.PathVariablesSet, name)
+	}
+}
+
+// editPathVariableNode makes PathVariableNode editable and keeps PathVariablesSet pointing to it.
+func (node *Node[T]) editPathVariableNode(tok *editToken) *Node[T] {
+	old := node.PathVariableNode
+	n := old.editable(tok)
+	if n != old {
+		node.PathVariableNode = n
+		for name, v := range node.PathVariablesSet {
+			if v == old {
+				node.PathVariablesSet[name] = n
+			}
+		}
+	}
+	return n
+}
+
+func (node *Node[T]) Clear() bool {
+	*node = Node[T]{}
+	return true
+}
+
+// IsEmpty return true if empty, a trie whose paths were all removed is empty again
+func (node *Node[T]) IsEmpty() bool {
+	return node.matchStr == "" && node.prunable()
 }
 
 // GetBizInfo get info
-func (node *Node) GetBizInfo() any {
+func (node *Node[T]) GetBizInfo() T {
 	return node.bizInfo
 }
 
 //Match node match
 
-func (node *Node) Match(parts []string) (*Node, []string, bool) {
+func (node *Node[T]) Match(parts []string) (*Node[T], []string, bool) {
+	return node.match(parts, nil)
+}
+
+// accepted a real path ends at node and accept agrees with its bizInfo
+func (node *Node[T]) accepted(accept func(bizInfo T) bool) bool {
+	return node.endOfPath && (accept == nil || accept(node.bizInfo))
+}
+
+func (node *Node[T]) match(parts []string, accept func(bizInfo T) bool) (*Node[T], []string, bool) {
 	key := parts[0]
 	childKeys := parts[1:]
 	// isEnd is the end of url path, means node is a place of url end,so the path with parentNode has a real url exists.
 	isEnd := len(childKeys) == 0
 	if isEnd {
 
-		if node.children != nil && node.children[key] != nil && node.children[key].endOfPath {
-			return node.children[key], []string{}, true
+		if c := node.child(key); c != nil && c.accepted(accept) {
+			return c, []string{}, true
+		}
+		for _, pn := range node.PatternNodes {
+			if pn.pattern.MatchString(key) && pn.accepted(accept) {
+				return pn, []string{key}, true
+			}
 		}
 		//consider  trie node ：/aaa/bbb/xxxxx/ccc/ddd  /aaa/bbb/:id/ccc   and request url is ：/aaa/bbb/xxxxx/ccc
 		if node.PathVariableNode != nil {
-			if node.PathVariableNode.endOfPath {
+			if node.PathVariableNode.accepted(accept) {
 				return node.PathVariableNode, []string{key}, true
 			}
 		}
 
 	} else {
-		if node.children != nil && node.children[key] != nil {
-			n, param, ok := node.children[key].Match(childKeys)
+		if c := node.child(key); c != nil {
+			n, param, ok := c.match(childKeys, accept)
 			if ok {
 				return n, param, ok
 			}
 		}
+		for _, pn := range node.PatternNodes {
+			if !pn.pattern.MatchString(key) {
+				continue
+			}
+			n, param, ok := pn.match(childKeys, accept)
+			if ok {
+				return n, append(param, key), ok
+			}
+		}
 		if node.PathVariableNode != nil {
-			n, param, ok := node.PathVariableNode.Match(childKeys)
+			n, param, ok := node.PathVariableNode.match(childKeys, accept)
 			param = append(param, key)
 			if ok {
 				return n, param, ok
 			}
 		}
 	}
-	if node.children != nil && node.children[key] != nil && node.children[key].MatchAllNode != nil {
-		return node.children[key].MatchAllNode, []string{}, true
+	if c := node.child(key); c != nil && c.MatchAllNode != nil && c.MatchAllNode.accepted(accept) {
+		return c.MatchAllNode, []string{}, true
 	}
-	if node.MatchAllNode != nil {
+	if node.MatchAllNode != nil && node.MatchAllNode.accepted(accept) {
 		return node.MatchAllNode, []string{}, true
 	}
 	return nil, nil, false
@@ -232,17 +513,24 @@ func (node *Node) Match(parts []string) (*Node, []string, bool) {
 
 // Get node get
 // returns:
-// *Node this node in path, if not exists return nil
+// *Node[T] this node in path, if not exists return nil
 // []string key reversed array of pathVariable   /:aa/:bb/:cc  returns array of (cc,bb,aa)
 // bool is ok
 // error
-func (node *Node) Get(keys []string) (*Node, []string, bool, error) {
+func (node *Node[T]) Get(keys []string) (*Node[T], []string, bool, error) {
 	key := keys[0]
 	childKeys := keys[1:]
 	isReal := len(childKeys) == 0
 	if isReal {
 		// exit condition
 		if utils.IsPathVariableOrWildcard(key) {
+			if name, constraint := utils.VariableConstraint(key); constraint != "" {
+				_, pn := node.patternNode(constraint)
+				if pn == nil || !pn.endOfPath {
+					return nil, nil, false, nil
+				}
+				return pn, []string{name}, true, nil
+			}
 			if node.PathVariableNode == nil || !node.PathVariableNode.endOfPath {
 				return nil, nil, false, nil
 			}
@@ -250,96 +538,125 @@ func (node *Node) Get(keys []string) (*Node, []string, bool, error) {
 		} else if utils.IsMatchAll(key) {
 			return node.MatchAllNode, nil, true, nil
 		} else {
-			if node.children == nil {
-				return nil, nil, false, nil
-			}
-			return node.children[key], nil, true, nil
+			return node.child(key), nil, true, nil
 		}
 	} else {
 
 		if utils.IsPathVariableOrWildcard(key) {
-			if node.PathVariableNode == nil {
+			next := node.PathVariableNode
+			if _, constraint := utils.VariableConstraint(key); constraint != "" {
+				_, next = node.patternNode(constraint)
+			}
+			if next == nil {
 				return nil, nil, false, nil
 			}
-			retNode, pathVariableList, ok, e := node.PathVariableNode.Get(childKeys)
+			retNode, pathVariableList, ok, e := next.Get(childKeys)
 			newList := []string{key}
 			copy(newList[1:], pathVariableList)
 			return retNode, newList, ok, e
 		} else if utils.IsMatchAll(key) {
 			return nil, nil, false, errors.Errorf("router configuration is empty")
 		} else {
-			if node.children == nil || node.children[key] == nil {
+			c := node.child(key)
+			if c == nil {
 				return nil, nil, false, nil
 			}
-			return node.children[key].Get(childKeys)
+			return c.Get(childKeys)
 		}
 	}
 
 }
 
-func (node *Node) put(key string, isReal bool, bizInfo any) bool {
+func (node *Node[T]) put(key string, isReal bool, bizInfo T, tok *editToken) bool {
 	if !utils.IsPathVariableOrWildcard(key) {
 		if utils.IsMatchAll(key) {
-			return node.putMatchAllNode(key, isReal, bizInfo)
+			return node.putMatchAllNode(key, isReal, bizInfo, tok)
 		} else {
-			return node.putNode(key, isReal, bizInfo)
+			return node.putNode(key, isReal, bizInfo, tok)
 		}
 	}
-	pathVariable := utils.VariableName(key)
-	return node.putPathVariable(pathVariable, isReal, bizInfo)
+	pathVariable, constraint := utils.VariableConstraint(key)
+	if constraint != "" {
+		return node.putPatternVariable(pathVariable, constraint, isReal, bizInfo, tok)
+	}
+	return node.putPathVariable(pathVariable, isReal, bizInfo, tok)
 }
 
-func (node *Node) putPathVariable(pathVariable string, isReal bool, bizInfo any) bool {
+func (node *Node[T]) putPatternVariable(pathVariable, constraint string, isReal bool, bizInfo T, tok *editToken) bool {
+	i, pn := node.patternNode(constraint)
+	if pn == nil {
+		pn = &Node[T]{endOfPath: false, pattern: utils.GetCachedAnchoredRegexp(constraint), owner: tok}
+		node.PatternNodes = append(node.PatternNodes, pn)
+		i = len(node.PatternNodes) - 1
+	}
+	if pn.endOfPath && isReal {
+		//has a node with same path exists. conflicted.
+		return false
+	}
+	pn = pn.editable(tok)
+	node.PatternNodes[i] = pn
+	if isReal {
+		pn.bizInfo = bizInfo
+		pn.matchStr = pathVariable
+	}
+	pn.endOfPath = pn.endOfPath || isReal
+	return true
+}
+
+func (node *Node[T]) putPathVariable(pathVariable string, isReal bool, bizInfo T, tok *editToken) bool {
 	//path variable put
 	if node.PathVariableNode == nil {
-		node.PathVariableNode = &Node{endOfPath: false}
+		node.PathVariableNode = &Node[T]{endOfPath: false, owner: tok}
 	}
 	if node.PathVariableNode.endOfPath && isReal {
 		//has a node with same path exists. conflicted.
 		return false
 	}
+	node.editPathVariableNode(tok)
 	if isReal {
 		node.PathVariableNode.bizInfo = bizInfo
 		node.PathVariableNode.matchStr = pathVariable
 	}
 	node.PathVariableNode.endOfPath = node.PathVariableNode.endOfPath || isReal
 	if node.PathVariablesSet == nil {
-		node.PathVariablesSet = map[string]*Node{}
+		node.PathVariablesSet = map[string]*Node[T]{}
 	}
 	node.PathVariablesSet[pathVariable] = node.PathVariableNode
 	return true
 }
 
-func (node *Node) putNode(matchStr string, isReal bool, bizInfo any) bool {
-	selfNode := &Node{endOfPath: isReal, matchStr: matchStr}
-	old := node.children[matchStr]
+func (node *Node[T]) putNode(matchStr string, isReal bool, bizInfo T, tok *editToken) bool {
+	old := node.child(matchStr)
+	if old != nil && old.endOfPath && isReal {
+		// already has one same path url
+		return false
+	}
+	var selfNode *Node[T]
 	if old != nil {
-		if old.endOfPath && isReal {
-			// already has one same path url
-			return false
-		}
-		selfNode = old
+		selfNode = old.editable(tok)
 	} else {
-		old = selfNode
+		selfNode = &Node[T]{matchStr: matchStr, owner: tok}
 	}
 
 	if isReal {
 		selfNode.bizInfo = bizInfo
+		selfNode.endOfPath = true
+	}
+	if selfNode != old {
+		node.children.set(matchStr, selfNode, tok)
 	}
-	selfNode.endOfPath = isReal || old.endOfPath
-	node.children[matchStr] = selfNode
 	return true
 }
 
-func (node *Node) putMatchAllNode(matchStr string, isReal bool, bizInfo any) bool {
-	selfNode := &Node{endOfPath: isReal, matchStr: matchStr}
+func (node *Node[T]) putMatchAllNode(matchStr string, isReal bool, bizInfo T, tok *editToken) bool {
+	selfNode := &Node[T]{endOfPath: isReal, matchStr: matchStr, owner: tok}
 	old := node.MatchAllNode
 	if old != nil {
 		if old.endOfPath && isReal {
 			// already has one same path url
 			return false
 		}
-		selfNode = old
+		selfNode = old.editable(tok)
 	} else {
 		old = selfNode
 	}
@@ -347,7 +664,7 @@ func (node *Node) putMatchAllNode(matchStr string, isReal bool, bizInfo any) boo
 	if isReal {
 		selfNode.bizInfo = bizInfo
 	}
-	selfNode.endOfPath = selfNode.endOfPath || old.endOfPath
+	selfNode.endOfPath = isReal || old.endOfPath
 	node.MatchAllNode = selfNode
 	return true
 }
@@ -0,0 +1,496 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package trie
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	utils "github.com/alanxtl/pixiu-router-update/utils"
+)
+
+func TestImmutableTrie_VersionsAreIndependent(t *testing.T) {
+	v1, ok, err := NewImmutableTrie[string]().Put("/api/v1/users/:id", "users")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	v1, _, _ = v1.Put("/api/v1/svc/**", "svc")
+
+	v2, ok, _ := v1.Put("/api/v1/orders", "orders")
+	assert.True(t, ok)
+	v3, _, _ := v2.Remove("/api/v1/users/:id")
+	v4, _, _ := v3.PutOrUpdate("/api/v1/svc/**", "svc-v4")
+
+	match := func(it ImmutableTrie[string], path string) string {
+		biz, _, _ := it.Match(path)
+		return biz
+	}
+
+	// v1 never sees later changes
+	assert.Equal(t, "users", match(v1, "/api/v1/users/42"))
+	assert.Empty(t, match(v1, "/api/v1/orders"))
+	assert.Equal(t, "svc", match(v1, "/api/v1/svc/a/b"))
+
+	assert.Equal(t, "users", match(v2, "/api/v1/users/42"))
+	assert.Equal(t, "orders", match(v2, "/api/v1/orders"))
+
+	assert.Empty(t, match(v3, "/api/v1/users/42"))
+	assert.Equal(t, "svc", match(v3, "/api/v1/svc/a/b"))
+
+	assert.Equal(t, "svc-v4", match(v4, "/api/v1/svc/a/b"))
+	assert.Equal(t, "orders", match(v4, "/api/v1/orders"))
+}
+
+func TestImmutableTrie_SharesUntouchedNodes(t *testing.T) {
+	v1, _, _ := NewImmutableTrie[int]().Put("/a/b/c", 1)
+	v1, _, _ = v1.Put("/x/y/z", 2)
+	v2, _, _ := v1.Put("/a/b/d", 3)
+
+	// untouched subtree is shared, changed path is copied
+	assert.Same(t, v1.t.root.child("x"), v2.t.root.child("x"))
+	assert.NotSame(t, v1.t.root.child("a"), v2.t.root.child("a"))
+	assert.Same(t, v1.t.root.child("a").child("b").child("c"), v2.t.root.child("a").child("b").child("c"))
+}
+
+func TestTrie_FreezeThenModify(t *testing.T) {
+	m := NewTrie[string]()
+	_, _ = m.Put("/a/:id", "a")
+	frozen := m.Freeze()
+
+	_, _ = m.PutOrUpdate("/a/:id", "a2")
+	_, _ = m.Put("/b", "b")
+
+	biz, _, ok := frozen.Match("/a/1")
+	assert.True(t, ok)
+	assert.Equal(t, "a", biz)
+	_, _, ok = frozen.Match("/b")
+	assert.False(t, ok)
+
+	biz, _, _ = m.Match("/a/1")
+	assert.Equal(t, "a2", biz)
+}
+
+func TestTrie_RegexConstrainedVariables(t *testing.T) {
+	tr := NewTrie[string]()
+	ok, err := tr.Put("/users/:id(\\d+)", "num")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	_, _ = tr.Put("/users/:id([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})", "uuid")
+	_, _ = tr.Put("/users/:name", "any")
+	_, _ = tr.Put("/users/:id(\\d+)/orders", "num-orders")
+	_, _ = tr.Put("/users/:name/profile", "profile")
+
+	cases := []struct {
+		path   string
+		biz    any
+		params []string
+	}{
+		{"/users/42", "num", []string{"42"}},
+		{"/users/0f8fad5b-d9cb-469f-a165-70867728950e", "uuid", []string{"0f8fad5b-d9cb-469f-a165-70867728950e"}},
+		{"/users/alice", "any", []string{"alice"}},
+		{"/users/42x", "any", []string{"42x"}},
+		{"/users/42/orders", "num-orders", []string{"42"}},
+		// constraint matches but the subtree does not, fall through to the plain variable
+		{"/users/42/profile", "profile", []string{"42"}},
+	}
+	for _, c := range cases {
+		biz, params, ok := tr.Match(c.path)
+		if assert.True(t, ok, c.path) {
+			assert.Equal(t, c.biz, biz, c.path)
+			assert.Equal(t, c.params, params, c.path)
+		}
+	}
+
+	_, _, ok = tr.Match("/users/alice/orders")
+	assert.False(t, ok)
+
+	_, err = tr.Put("/users/:id([0-9)", "bad")
+	assert.Error(t, err)
+
+	// a second route with the same constraint conflicts, whatever the variable name
+	ok, _ = tr.Put("/users/:uid(\\d+)", "dup")
+	assert.False(t, ok)
+
+	_, _ = tr.Remove("/users/:id(\\d+)")
+	biz, _, _ := tr.Match("/users/42")
+	assert.Equal(t, "any", biz)
+}
+
+func TestTrie_MatchFuncFallsThrough(t *testing.T) {
+	tr := NewTrie[string]()
+	_, _ = tr.Put("/api/orders", "static")
+	_, _ = tr.Put("/api/:name", "variable")
+	_, _ = tr.Put("/api/**", "prefix")
+
+	accept := func(rejected ...string) func(string) bool {
+		return func(bizInfo string) bool {
+			for _, r := range rejected {
+				if bizInfo == r {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	biz, _, ok := tr.MatchFunc("/api/orders", nil)
+	assert.True(t, ok)
+	assert.Equal(t, "static", biz)
+
+	biz, params, ok := tr.MatchFunc("/api/orders", accept("static"))
+	assert.True(t, ok)
+	assert.Equal(t, "variable", biz)
+	assert.Equal(t, []string{"orders"}, params)
+
+	biz, _, ok = tr.MatchFunc("/api/orders", accept("static", "variable"))
+	assert.True(t, ok)
+	assert.Equal(t, "prefix", biz)
+
+	_, _, ok = tr.MatchFunc("/api/orders", accept("static", "variable", "prefix"))
+	assert.False(t, ok)
+}
+
+func TestTrie_PutRejectsNil(t *testing.T) {
+	type leaf struct{ id string }
+	tr := NewTrie[*leaf]()
+	ok, err := tr.Put("/a", nil)
+	assert.Error(t, err)
+	assert.False(t, ok)
+	_, err = tr.PutOrUpdate("/a", (*leaf)(nil))
+	assert.Error(t, err)
+	_, _, ok = tr.Match("/a")
+	assert.False(t, ok)
+
+	_, err = tr.Put("/a", &leaf{id: "a"})
+	assert.NoError(t, err)
+	_, err = tr.PutOrUpdate("/a", nil)
+	assert.Error(t, err)
+	biz, _, ok := tr.Match("/a")
+	assert.True(t, ok)
+	assert.Equal(t, "a", biz.id)
+
+	// values of a non nilable T are never nil
+	ints := NewTrie[int]()
+	ok, err = ints.Put("/zero", 0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestTrie_RemovePrunesVariableBranches(t *testing.T) {
+	tr := NewTrie[string]()
+	_, _ = tr.Put("/users/:id/orders/:oid", "order")
+	_, _ = tr.Put("/users/:id", "user")
+	_, _ = tr.Put("/users/:id(\\d+)/items", "items")
+
+	// a path that does not exist removes nothing
+	res, err := tr.Remove("/users/:id/orders")
+	assert.NoError(t, err)
+	assert.Equal(t, RemoveResult[string]{}, res)
+
+	res, err = tr.Remove("/users/:id/orders/:oid")
+	assert.NoError(t, err)
+	assert.Equal(t, RemoveResult[string]{Removed: true, BizInfo: "order", Pruned: 2}, res)
+	users := tr.root.child("users")
+	assert.Zero(t, users.PathVariableNode.children.len())
+	_, _, ok := tr.Match("/users/1/orders/2")
+	assert.False(t, ok)
+
+	// the variable node still ends a path, it is kept
+	res, _ = tr.Remove("/users/:id")
+	assert.Equal(t, RemoveResult[string]{Removed: true, BizInfo: "user", Pruned: 1}, res)
+	assert.Nil(t, users.PathVariableNode)
+	assert.Nil(t, users.PathVariablesSet)
+	_, _, ok = tr.Match("/users/1")
+	assert.False(t, ok)
+
+	res, _ = tr.Remove("/users/:id(\\d+)/items")
+	assert.Equal(t, RemoveResult[string]{Removed: true, BizInfo: "items", Pruned: 3}, res)
+	assert.True(t, tr.IsEmpty())
+}
+
+func TestTrie_RemoveDropsVariableName(t *testing.T) {
+	tr := NewTrie[string]()
+	_, _ = tr.Put("/a/:id", "id")
+	_, _ = tr.Put("/a/:name/x", "x")
+	_, _ = tr.Put("/a/:name/y", "y")
+	ok, _ := tr.Put("/a/:other/x", "dup")
+	assert.False(t, ok)
+	a := tr.root.child("a")
+	assert.NotContains(t, a.PathVariablesSet, "other")
+
+	// the variable node still has children, it is kept without the name of the removed path
+	res, err := tr.Remove("/a/:id")
+	assert.NoError(t, err)
+	assert.Equal(t, RemoveResult[string]{Removed: true, BizInfo: "id"}, res)
+	assert.NotContains(t, a.PathVariablesSet, "id")
+	assert.Contains(t, a.PathVariablesSet, "name")
+	assert.Empty(t, a.PathVariableNode.matchStr)
+
+	// a name stays as long as one of its paths does
+	_, _ = tr.Remove("/a/:name/x")
+	assert.Contains(t, a.PathVariablesSet, "name")
+	res, _ = tr.Remove("/a/:name/y")
+	assert.Equal(t, 3, res.Pruned)
+	assert.True(t, tr.IsEmpty())
+}
+
+func TestTrie_RemoveWildcardAndMatchAll(t *testing.T) {
+	tr := NewTrie[string]()
+	_, _ = tr.Put("/static/*/logo", "logo")
+	_, _ = tr.Put("/static/**", "static")
+	_, _ = tr.Put("/api/**", "api")
+	_, _ = tr.Put("/api/v1", "v1")
+
+	res, _ := tr.Remove("/static/*/logo")
+	assert.Equal(t, RemoveResult[string]{Removed: true, BizInfo: "logo", Pruned: 2}, res)
+	biz, _, ok := tr.Match("/static/x/logo")
+	if assert.True(t, ok) {
+		assert.Equal(t, "static", biz)
+	}
+
+	res, _ = tr.Remove("/static/**")
+	assert.Equal(t, RemoveResult[string]{Removed: true, BizInfo: "static", Pruned: 2}, res)
+	assert.Nil(t, tr.root.child("static"))
+	_, _, ok = tr.Match("/static/x/logo")
+	assert.False(t, ok)
+
+	// /api still holds v1, only the match all node goes
+	res, _ = tr.Remove("/api/**")
+	assert.Equal(t, RemoveResult[string]{Removed: true, BizInfo: "api", Pruned: 1}, res)
+	assert.Nil(t, tr.root.child("api").MatchAllNode)
+	_, _, ok = tr.Match("/api/v2")
+	assert.False(t, ok)
+	biz, _, _ = tr.Match("/api/v1")
+	assert.Equal(t, "v1", biz)
+
+	res, _ = tr.Remove("/api/**")
+	assert.False(t, res.Removed)
+	_, err := tr.Remove("/api/**/x")
+	assert.Error(t, err)
+}
+
+func TestTrie_RemoveOnForkKeepsBase(t *testing.T) {
+	v1, _, _ := NewImmutableTrie[string]().Put("/a/:id/b", "b")
+	v1, _, _ = v1.Put("/x", "x")
+
+	// churn leaves no node behind
+	v2 := v1
+	for i := 0; i < 3; i++ {
+		v2, _, _ = v2.Put("/tmp/:id/c/**", "tmp")
+		v2, _, _ = v2.Remove("/tmp/:id/c/**")
+	}
+	assert.Nil(t, v2.t.root.child("tmp"))
+
+	v3, res, _ := v2.Remove("/a/:id/b")
+	assert.Equal(t, 3, res.Pruned)
+	assert.Nil(t, v3.t.root.child("a"))
+	biz, _, ok := v1.Match("/a/1/b")
+	if assert.True(t, ok) {
+		assert.Equal(t, "b", biz)
+	}
+	assert.Same(t, v1.t.root.child("x"), v3.t.root.child("x"))
+
+	// updating a path keeps its nodes
+	v4, ok, _ := v1.PutOrUpdate("/a/:id/b", "b2")
+	assert.True(t, ok)
+	biz, _, _ = v4.Match("/a/1/b")
+	assert.Equal(t, "b2", biz)
+	biz, _, _ = v1.Match("/a/1/b")
+	assert.Equal(t, "b", biz)
+}
+
+func TestRadix_CompressesAndReusesSubtrees(t *testing.T) {
+	v1, _, _ := NewImmutableTrie[string]().Put("/api/v1/users/:id", "user")
+	v1, _, _ = v1.Put("/static/css/site/main.css", "css")
+	r1 := CompileRadix(&v1, nil)
+
+	// static chains without branch are one edge
+	e := r1.root.edge("api")
+	assert.NotNil(t, e)
+	assert.Equal(t, 3, e.segs)
+	assert.Equal(t, "v1/users", e.tail)
+	assert.NotNil(t, e.node.variable)
+	assert.Equal(t, "static", r1.root.edge("static").first)
+	assert.Equal(t, "css/site/main.css", r1.root.edge("static").tail)
+
+	// the changed chain is recompiled, the untouched one is shared
+	v2, _, _ := v1.Put("/api/v1/orders", "orders")
+	r2 := CompileRadix(&v2, r1)
+	assert.Same(t, r1.root.edge("static").node, r2.root.edge("static").node)
+	assert.Equal(t, 2, r2.root.edge("api").segs)
+	assert.Same(t, r1.root.edge("api").node.variable.src, r2.root.edge("api").node.edge("users").node.variable.src)
+
+	biz, params, ok := r2.Match("/api/v1/users/42?x=1")
+	assert.True(t, ok)
+	assert.Equal(t, "user", biz)
+	assert.Equal(t, []string{"42"}, params)
+	biz, _, _ = r2.Match("/api/v1/orders")
+	assert.Equal(t, "orders", biz)
+	_, _, ok = r1.Match("/api/v1/orders")
+	assert.False(t, ok)
+	_, _, ok = r2.Match("/static/css")
+	assert.False(t, ok)
+}
+
+func TestRadix_WideNodeRecompilesChangedEdges(t *testing.T) {
+	v1 := NewImmutableTrie[int]()
+	for i := 0; i < 1000; i++ {
+		v1, _, _ = v1.Put("/item/"+strconv.Itoa(i), i)
+	}
+	r1 := CompileRadix(&v1, nil)
+	v2, _, _ := v1.PutOrUpdate("/item/500", -1)
+	v2, _, _ = v2.Put("/item/x/y", -2)
+	v2, _, _ = v2.Remove("/item/7")
+	r2 := CompileRadix(&v2, r1)
+
+	for i := 0; i < 1000; i++ {
+		path := "/item/" + strconv.Itoa(i)
+		biz, _, ok := r2.Match(path)
+		switch i {
+		case 7:
+			assert.False(t, ok, path)
+		case 500:
+			assert.Equal(t, -1, biz, path)
+		default:
+			assert.Equal(t, i, biz, path)
+		}
+		biz, _, _ = r1.Match(path)
+		assert.Equal(t, i, biz, path)
+	}
+	biz, _, _ := r2.Match("/item/x/y")
+	assert.Equal(t, -2, biz)
+
+	// only the edge nodes on the way to the changed keys are new
+	old := map[*radixEdges[int]]bool{}
+	for _, es := range edgeNodes(r1.root.edge("item").node.edges) {
+		old[es] = true
+	}
+	all := edgeNodes(r2.root.edge("item").node.edges)
+	fresh := 0
+	for _, es := range all {
+		if !old[es] {
+			fresh++
+		}
+	}
+	assert.Greater(t, len(all), 30)
+	assert.LessOrEqual(t, fresh, 6)
+}
+
+// edgeNodes es and the nodes below it
+func edgeNodes[T any](es *radixEdges[T]) []*radixEdges[T] {
+	out := []*radixEdges[T]{es}
+	for _, kid := range es.kids {
+		out = append(out, edgeNodes(kid)...)
+	}
+	return out
+}
+
+func TestRadix_MatchesTrie(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	segs := []string{"a", "b", "api", "v1", "1", "42", ""}
+	patterns := []string{"a", "b", "api", "v1", ":id", ":n(\\d+)", "*"}
+	randomKey := func(vocab []string, matchAll bool) string {
+		n := 1 + rnd.Intn(4)
+		parts := make([]string, 0, n+1)
+		for i := 0; i < n; i++ {
+			parts = append(parts, vocab[rnd.Intn(len(vocab))])
+		}
+		if matchAll && rnd.Intn(4) == 0 {
+			parts = append(parts, "**")
+		}
+		return "/" + strings.Join(parts, "/")
+	}
+	// reject every other value, so that MatchFunc falls through
+	accept := func(biz int) bool { return biz%2 == 0 }
+	normalize := func(params []string) []string {
+		if len(params) == 0 {
+			return nil
+		}
+		return params
+	}
+
+	it := NewImmutableTrie[int]()
+	var r *Radix[int]
+	var keys []string
+	for version := 0; version < 50; version++ {
+		for i := 0; i < 10; i++ {
+			if len(keys) > 0 && rnd.Intn(3) == 0 {
+				k := keys[rnd.Intn(len(keys))]
+				it, _, _ = it.Remove(k)
+				continue
+			}
+			k := randomKey(patterns, true)
+			var err error
+			it, _, err = it.PutOrUpdate(k, rnd.Intn(100))
+			assert.NoError(t, err)
+			keys = append(keys, k)
+		}
+		r = CompileRadix(&it, r)
+		fresh := CompileRadix(&it, nil)
+		for i := 0; i < 200; i++ {
+			path := randomKey(segs, false)
+			want, wantParams, wantOK := it.Match(path)
+			for _, rx := range []*Radix[int]{r, fresh} {
+				biz, params, ok := rx.Match(path)
+				assert.Equal(t, wantOK, ok, path)
+				assert.Equal(t, want, biz, path)
+				assert.Equal(t, normalize(wantParams), params, path)
+			}
+
+			want, wantParams, wantOK = it.MatchFunc(path, accept)
+			biz, params, ok := r.MatchFunc(path, accept)
+			assert.Equal(t, wantOK, ok, path)
+			assert.Equal(t, want, biz, path)
+			assert.Equal(t, normalize(wantParams), params, path)
+		}
+	}
+}
+
+func TestRadix_MatchAppendFollowsTrieKey(t *testing.T) {
+	tr := NewTrie[string]()
+	_, _ = tr.Put("GET", "root")
+	_, _ = tr.Put("GET/api/items", "items")
+	_, _ = tr.Put("GET/api/items/", "items-slash")
+	_, _ = tr.Put("GET/users/:id", "user")
+	_, _ = tr.Put("GET/static/**", "static")
+	it := tr.Freeze()
+	r := CompileRadix(&it, nil)
+
+	buf := make([]string, 0, 4)
+	for _, path := range []string{
+		"/", "", "//", "?x=1", "/api/items", "/api/items/", "/api/items/?x=1", "/api/items//",
+		"api/items", "http://host/api/items?q=1", "/users/42", "/users/42/", "/static/a/b", "/missing",
+	} {
+		want, wantParams, wantOK := r.Match(utils.GetTrieKey("GET", path))
+		rest, more := utils.TrieKeyPath(path)
+		biz, params, ok := r.MatchAppend("GET", rest, more, nil, buf[:0])
+		assert.Equal(t, wantOK, ok, path)
+		assert.Equal(t, want, biz, path)
+		assert.Equal(t, len(wantParams), len(params), path)
+		for i := range wantParams {
+			assert.Equal(t, wantParams[i], params[i], path)
+		}
+	}
+}
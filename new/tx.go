@@ -0,0 +1,88 @@
+package new
+
+import (
+	"errors"
+)
+
+import (
+	"github.com/alanxtl/pixiu-router-update/new/model"
+)
+
+// ErrTxDone Apply or Commit on a transaction already committed or discarded
+var ErrTxDone = errors.New("transaction already committed or discarded")
+
+// RouteChange a change staged in a Tx
+type RouteChange struct {
+	Host   string        // virtual host of Route, model.DefaultHost for a route outside of any virtual host
+	Route  *model.Router // route to add or replace
+	Delete string        // id of the route to delete, used when Route is nil
+}
+
+// Tx a batch of route changes published as one snapshot by Commit, or not at all.
+// A Tx is not safe for concurrent use.
+type Tx struct {
+	rm      *RouterCoordinator
+	changes []RouteChange
+	done    bool
+}
+
+// Begin start a transaction, nothing is visible before Commit
+func (rm *RouterCoordinator) Begin() *Tx {
+	return &Tx{rm: rm}
+}
+
+// Apply stage changes, applied in order by Commit
+func (tx *Tx) Apply(changes ...RouteChange) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.changes = append(tx.changes, changes...)
+	return nil
+}
+
+// Discard drop the staged changes
+func (tx *Tx) Discard() {
+	tx.done = true
+	tx.changes = nil
+}
+
+// Commit validate the staged changes and publish them at once, together with the changes pending in the debounce window.
+// Nothing is applied when a staged route is invalid, the model.ValidationErrors are returned.
+// In PublishStrict mode an invalid pending change rejects the publish as well, its error is returned.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	var errs model.ValidationErrors
+	for _, c := range tx.changes {
+		if c.Route == nil {
+			continue
+		}
+		rerrs := model.ValidateRouter(c.Route)
+		for _, e := range rerrs {
+			e.VirtualHost = c.Host
+		}
+		errs = append(errs, rerrs...)
+	}
+	if err := errs.Err(); err != nil {
+		return err
+	}
+
+	rm := tx.rm
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	for _, c := range tx.changes {
+		if c.Route != nil {
+			rm.addLocked(c.Host, c.Route)
+		} else {
+			rm.deleteLocked(c.Delete)
+		}
+	}
+	rm.stopTimerLocked()
+	rm.publishLocked()
+	if rm.mode == PublishStrict {
+		return rm.lastErr
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package new
+
+import (
+	"sync"
+	"time"
+)
+
+// SnapshotEvent what changed with the switch to a new active snapshot
+type SnapshotEvent struct {
+	Version  uint64 // version of the new active snapshot
+	Previous uint64 // version of the snapshot it replaced
+
+	// route ids, sorted
+	Added   []string
+	Removed []string
+	Changed []string // replaced or moved to another virtual host
+
+	VirtualHostsChanged bool          // domains of the virtual hosts changed
+	Rollback            bool          // published by Rollback
+	BuildDuration       time.Duration // from the start of the publish to the atomic switch
+}
+
+// subscriber delivers events to fn in publish order, on its own goroutine so a slow fn never holds back a publish
+type subscriber struct {
+	fn    func(SnapshotEvent)
+	mu    sync.Mutex
+	queue []SnapshotEvent
+	wake  chan struct{} // signaled when queue gets an event, or when the subscriber is closed
+	done  chan struct{} // closed by unsubscribe
+	once  sync.Once
+	last  bool // closed with the coordinator, exit once the queue is delivered
+}
+
+// Subscribe call fn after each atomic switch to a new snapshot, until the returned function is called or the coordinator is closed.
+// Events are delivered one at a time and in version order, fn may call the coordinator.
+// Subscribing to a closed coordinator delivers nothing.
+func (rm *RouterCoordinator) Subscribe(fn func(SnapshotEvent)) (unsubscribe func()) {
+	sub := &subscriber{
+		fn:   fn,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	rm.mu.Lock()
+	if rm.closed {
+		rm.mu.Unlock()
+		return func() {}
+	}
+	if rm.subs == nil {
+		rm.subs = make(map[*subscriber]struct{})
+	}
+	rm.subs[sub] = struct{}{}
+	rm.mu.Unlock()
+	go sub.run()
+	return func() {
+		rm.mu.Lock()
+		delete(rm.subs, sub)
+		rm.mu.Unlock()
+		sub.once.Do(func() { close(sub.done) })
+	}
+}
+
+// notifyLocked queue ev for every subscriber
+func (rm *RouterCoordinator) notifyLocked(ev SnapshotEvent) {
+	for sub := range rm.subs {
+		sub.push(ev)
+	}
+}
+
+func (s *subscriber) push(ev SnapshotEvent) {
+	s.mu.Lock()
+	s.queue = append(s.queue, ev)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close exit once the queued events are delivered
+func (s *subscriber) close() {
+	s.mu.Lock()
+	s.last = true
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		}
+		for {
+			s.mu.Lock()
+			if len(s.queue) == 0 {
+				last := s.last
+				s.mu.Unlock()
+				if last {
+					return
+				}
+				break
+			}
+			ev := s.queue[0]
+			s.queue[0] = SnapshotEvent{}
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			s.fn(ev)
+		}
+	}
+}
@@ -1,13 +1,19 @@
 package pixiu_router_update
 
 import (
+	"context"
+	"errors"
 	newrouter "github.com/alanxtl/pixiu-router-update/new"
 	newmodel "github.com/alanxtl/pixiu-router-update/new/model"
 	oldrouter "github.com/alanxtl/pixiu-router-update/old"
+	"math"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"strconv"
 	"testing"
+	"time"
 
 	oldmodel "github.com/alanxtl/pixiu-router-update/old/model"
 )
@@ -27,7 +33,9 @@ type RouteSpec struct {
 	Methods []string
 	Path    string
 	Prefix  string
+	Regex   string // new router only
 	Headers []HeaderSpec
+	Query   []newmodel.QueryParamMatcher // new router only
 	Cluster string
 }
 
@@ -56,10 +64,12 @@ func (s RouteSpec) toNew() *newmodel.Router {
 	return &newmodel.Router{
 		ID: s.ID,
 		Match: newmodel.RouterMatch{
-			Methods: append([]string(nil), s.Methods...),
-			Path:    s.Path,
-			Prefix:  s.Prefix,
-			Headers: h,
+			Methods:     append([]string(nil), s.Methods...),
+			Path:        s.Path,
+			Prefix:      s.Prefix,
+			Regex:       s.Regex,
+			Headers:     h,
+			QueryParams: s.Query,
 		},
 		Route: newmodel.RouteAction{Cluster: s.Cluster},
 	}
@@ -83,6 +93,16 @@ func buildNew(specs []RouteSpec) *newrouter.RouterCoordinator {
 	return newrouter.CreateRouterCoordinator(cfg)
 }
 
+// flush publish the pending changes of c
+func flush(t testing.TB, c *newrouter.RouterCoordinator) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
 type res struct {
 	ok      bool
 	cluster string
@@ -260,6 +280,965 @@ func TestVariables_SingleAndMulti(t *testing.T) {
 	assertSame(t, oldc, newc, "GET", syntax.multiPattern("12", "34")+"/extra", nil, true, "c-pre")
 }
 
+// the old router has no regex constraint support, only the new one is checked
+func TestVariables_RegexConstraint(t *testing.T) {
+	syntax = colonSyntax()
+	digits, _ := syntax.digitsPattern("id")
+	specs := []RouteSpec{
+		{ID: "num", Methods: []string{"GET"}, Path: digits, Cluster: "c-num"},
+		{ID: "uuid", Methods: []string{"GET"}, Path: "/users/:id([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})", Cluster: "c-uuid"},
+		{ID: "any", Methods: []string{"GET"}, Path: syntax.simplePattern("name"), Cluster: "c-any"},
+	}
+	newc := buildNew(specs)
+
+	cases := []struct {
+		path    string
+		cluster string
+	}{
+		{"/users/777", "c-num"},
+		{"/users/0f8fad5b-d9cb-469f-a165-70867728950e", "c-uuid"},
+		{"/users/alice", "c-any"},
+	}
+	for _, tc := range cases {
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		act, err := newc.Route(req)
+		if err != nil || act.Cluster != tc.cluster {
+			t.Fatalf("GET %s: want %q, got %v %v", tc.path, tc.cluster, act, err)
+		}
+	}
+}
+
+func TestVariables_QueryAfterUnbalancedParen(t *testing.T) {
+	newc := buildNew([]RouteSpec{
+		{ID: "file", Methods: []string{"GET"}, Path: "/files/:name", Cluster: "c-file"},
+		{ID: "paren", Methods: []string{"GET"}, Path: "/static/a(b", Cluster: "c-paren"},
+	})
+	for path, want := range map[string]string{"/files/a(b?x=1/2": "c-file", "/static/a(b?x=1": "c-paren", "/static/a(b?x=(1)": "c-paren"} {
+		act, err := newc.RouteByPathAndName(path, "GET")
+		if err != nil || act.Cluster != want {
+			t.Fatalf("GET %s: want %s, got %v %v", path, want, act, err)
+		}
+	}
+}
+
+func TestVariables_NamedParams(t *testing.T) {
+	syntax = colonSyntax()
+	digits, _ := syntax.digitsPattern("id")
+	specs := []RouteSpec{
+		{ID: "one", Methods: []string{"GET"}, Path: digits, Cluster: "c-one"},
+		{ID: "two", Methods: []string{"GET"}, Path: syntax.multiPattern("shopId", "orderId"), Cluster: "c-two"},
+		{ID: "pre", Methods: []string{"GET"}, Prefix: "/tenants/:tenant/", Cluster: "c-pre"},
+		{ID: "hdr", Methods: []string{"GET"}, Headers: []HeaderSpec{{Name: "X-Env", Values: []string{"prod"}}}, Cluster: "c-hdr"},
+	}
+	newc := buildNew(specs)
+
+	cases := []struct {
+		path    string
+		hdr     map[string]string
+		id      string
+		pattern string
+		params  map[string]string
+	}{
+		{"/users/777", nil, "one", digits, map[string]string{"id": "777"}},
+		{"/shops/12/orders/34", nil, "two", syntax.multiPattern("shopId", "orderId"), map[string]string{"shopId": "12", "orderId": "34"}},
+		{"/tenants/acme/a/b", nil, "pre", "/tenants/:tenant/", map[string]string{"tenant": "acme"}},
+		{"/users/777", map[string]string{"X-Env": "prod"}, "hdr", "", nil},
+	}
+	for _, tc := range cases {
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		for k, v := range tc.hdr {
+			req.Header.Set(k, v)
+		}
+		m, err := newc.MatchRoute(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tc.path, err)
+		}
+		if m.RouteID != tc.id || m.Pattern != tc.pattern || !reflect.DeepEqual(m.Params, tc.params) {
+			t.Fatalf("GET %s: want {%s %s %v}, got {%s %s %v}", tc.path, tc.id, tc.pattern, tc.params, m.RouteID, m.Pattern, m.Params)
+		}
+	}
+
+	m, err := newc.MatchRouteByPathAndName("/users/42", "GET")
+	if err != nil || m.Params["id"] != "42" || m.Action.Cluster != "c-one" {
+		t.Fatalf("MatchRouteByPathAndName: %v %v", m, err)
+	}
+}
+
+// precedence of the new router: header-only routes, then the trie (path / prefix / variables), then regex routes in config order
+func TestPrecedence_RegexRoutes(t *testing.T) {
+	specs := []RouteSpec{
+		{ID: "re", Methods: []string{"GET"}, Regex: `/legacy/[a-z]+\.do`, Cluster: "c-re"},
+		{ID: "re-shadowed", Methods: []string{"GET"}, Regex: `/legacy/.*`, Cluster: "c-re-shadowed"},
+		{ID: "re-params", Methods: []string{"GET"}, Regex: `/reports/(?P<year>\d{4})/(?P<month>\d{2})`, Cluster: "c-reports"},
+		{ID: "re-hdr", Methods: []string{"GET"}, Regex: `/beta/.+`, Headers: []HeaderSpec{{Name: "X-Beta", Values: []string{"1"}}}, Cluster: "c-beta"},
+		{ID: "exact", Methods: []string{"GET"}, Path: "/legacy/report.do", Cluster: "c-exact"},
+		{ID: "pre", Methods: []string{"GET"}, Prefix: "/api/", Cluster: "c-pre"},
+		{ID: "hdr", Methods: []string{"GET"}, Headers: []HeaderSpec{{Name: "X-Env", Values: []string{"prod"}}}, Cluster: "c-hdr"},
+	}
+	newc := buildNew(specs)
+
+	cases := []struct {
+		name    string
+		path    string
+		hdr     map[string]string
+		ok      bool
+		cluster string
+	}{
+		{"trie.over.regex", "/legacy/report.do", nil, true, "c-exact"},
+		{"regex", "/legacy/export.do", nil, true, "c-re"},
+		{"regex.config_order", "/legacy/export.jsp", nil, true, "c-re-shadowed"},
+		{"prefix.over.regex", "/api/legacy/export.do", nil, true, "c-pre"},
+		{"header.over.regex", "/legacy/export.do", map[string]string{"X-Env": "prod"}, true, "c-hdr"},
+		{"regex.whole_path", "/reports/2024/05/extra", nil, false, ""},
+		{"regex.headers.hit", "/beta/x", map[string]string{"X-Beta": "1"}, true, "c-beta"},
+		{"regex.headers.miss", "/beta/x", nil, false, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", tc.path, nil)
+			for k, v := range tc.hdr {
+				req.Header.Set(k, v)
+			}
+			act, err := newc.Route(req)
+			if (err == nil) != tc.ok || (tc.ok && act.Cluster != tc.cluster) {
+				t.Fatalf("GET %s hdr=%v: want ok=%v %q, got %v %v", tc.path, tc.hdr, tc.ok, tc.cluster, act, err)
+			}
+		})
+	}
+
+	m, err := newc.MatchRouteByPathAndName("/reports/2024/05", "GET")
+	if err != nil || m.RouteID != "re-params" || m.Params["year"] != "2024" || m.Params["month"] != "05" {
+		t.Fatalf("regex params: %v %v", m, err)
+	}
+}
+
+// a regex can not narrow a path or prefix route: the combination is reported and never served, in both publish modes
+func TestValidation_RegexWithPathRejected(t *testing.T) {
+	both := []RouteSpec{
+		{ID: "path+re", Methods: []string{"GET"}, Path: "/a", Regex: "/a|/b", Cluster: "c-path"},
+		{ID: "pre+re", Methods: []string{"GET"}, Prefix: "/p/", Regex: "/p/.*", Cluster: "c-pre"},
+	}
+	newc := buildNew(both)
+	var errs newmodel.ValidationErrors
+	if err := newc.LastPublishError(); !errors.As(err, &errs) || len(errs) != 2 || errs[0].Field != "match" || errs[1].Field != "match" {
+		t.Fatalf("want both combinations reported, got %v", err)
+	}
+	for _, path := range []string{"/a", "/b", "/p/x"} {
+		if act, err := newc.RouteByPathAndName(path, "GET"); err == nil {
+			t.Fatalf("GET %s: want no match, got %s", path, act.Cluster)
+		}
+	}
+
+	newc.SetPublishMode(newrouter.PublishStrict)
+	newc.OnAddRouter(RouteSpec{ID: "ok", Methods: []string{"GET"}, Path: "/ok", Cluster: "c-ok"}.toNew())
+	newc.OnAddRouter(both[0].toNew())
+	flush(t, newc)
+	if newc.LastPublishError() == nil {
+		t.Fatal("want the combination rejected")
+	}
+	if act, err := newc.RouteByPathAndName("/ok", "GET"); err == nil {
+		t.Fatalf("rejected batch published: %s", act.Cluster)
+	}
+}
+
+// path / prefix routes with headers: candidates of one trie node with headers are tried first, then the ones without,
+// each group in config order; when none matches, the next route matching the path is tried
+func TestCombined_PathAndHeaders(t *testing.T) {
+	specs := []RouteSpec{
+		{ID: "orders", Methods: []string{"GET"}, Path: "/api/orders", Cluster: "c-orders"},
+		{ID: "orders-canary", Methods: []string{"GET"}, Path: "/api/orders", Headers: []HeaderSpec{{Name: "X-Env", Values: []string{"canary"}}}, Cluster: "c-canary"},
+		{ID: "orders-beta", Methods: []string{"GET"}, Path: "/api/orders", Headers: []HeaderSpec{{Name: "X-Beta", Values: []string{"^(1|true)$"}, Regex: true}}, Cluster: "c-beta"},
+		{ID: "user-beta", Methods: []string{"GET"}, Path: "/api/users/:id", Headers: []HeaderSpec{{Name: "X-Beta", Values: []string{"1"}}}, Cluster: "c-user-beta"},
+		{ID: "user-name", Methods: []string{"GET"}, Path: "/api/users/:name", Cluster: "c-user-name"},
+		{ID: "items-beta", Methods: []string{"GET"}, Path: "/api/items/:id", Headers: []HeaderSpec{{Name: "X-Beta", Values: []string{"1"}}}, Cluster: "c-items-beta"},
+		{ID: "api", Methods: []string{"GET"}, Prefix: "/api/", Cluster: "c-api"},
+	}
+	newc := buildNew(specs)
+
+	cases := []struct {
+		name    string
+		path    string
+		hdr     map[string]string
+		cluster string
+		params  map[string]string
+	}{
+		{"no.header", "/api/orders", nil, "c-orders", nil},
+		{"header.before.plain", "/api/orders", map[string]string{"X-Env": "canary"}, "c-canary", nil},
+		{"header.config_order", "/api/orders", map[string]string{"X-Env": "canary", "X-Beta": "1"}, "c-canary", nil},
+		{"header.regex", "/api/orders", map[string]string{"X-Beta": "true"}, "c-beta", nil},
+		{"header.mismatch", "/api/orders", map[string]string{"X-Env": "prod"}, "c-orders", nil},
+		{"same.node.header", "/api/users/7", map[string]string{"X-Beta": "1"}, "c-user-beta", map[string]string{"id": "7"}},
+		{"same.node.plain", "/api/users/7", nil, "c-user-name", map[string]string{"name": "7"}},
+		{"fall.through.prefix", "/api/items/7", nil, "c-api", nil},
+		{"variable.header", "/api/items/7", map[string]string{"X-Beta": "1"}, "c-items-beta", map[string]string{"id": "7"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", tc.path, nil)
+			for k, v := range tc.hdr {
+				req.Header.Set(k, v)
+			}
+			m, err := newc.MatchRoute(req)
+			if err != nil || m.Action.Cluster != tc.cluster || !reflect.DeepEqual(m.Params, tc.params) {
+				t.Fatalf("GET %s hdr=%v: want %q %v, got %v %v", tc.path, tc.hdr, tc.cluster, tc.params, m, err)
+			}
+		})
+	}
+
+	// without a request, routes with headers never match
+	if act, err := newc.RouteByPathAndName("/api/items/7", "GET"); err != nil || act.Cluster != "c-api" {
+		t.Fatalf("RouteByPathAndName: %v %v", act, err)
+	}
+
+	// incremental: removing the plain route keeps the header candidates of the node
+	newc.OnDeleteRouter(specs[0].toNew())
+	flush(t, newc)
+	req, _ := http.NewRequest("GET", "/api/orders", nil)
+	if act, err := newc.Route(req); err != nil || act.Cluster != "c-api" {
+		t.Fatalf("after delete, plain: %v %v", act, err)
+	}
+	req.Header.Set("X-Env", "canary")
+	if act, err := newc.Route(req); err != nil || act.Cluster != "c-canary" {
+		t.Fatalf("after delete, canary: %v %v", act, err)
+	}
+}
+
+func TestQueryParams(t *testing.T) {
+	specs := []RouteSpec{
+		{ID: "v2", Methods: []string{"GET"}, Path: "/api/orders", Query: []newmodel.QueryParamMatcher{{Name: "version", Values: []string{"2"}}}, Cluster: "c-v2"},
+		{ID: "v3+", Methods: []string{"GET"}, Path: "/api/orders", Query: []newmodel.QueryParamMatcher{{Name: "version", Values: []string{`^[3-9]$`}, Regex: true}}, Cluster: "c-v3"},
+		{ID: "orders", Methods: []string{"GET"}, Path: "/api/orders", Cluster: "c-orders"},
+		{ID: "debug", Methods: []string{"GET"}, Prefix: "/api/", Query: []newmodel.QueryParamMatcher{{Name: "debug", Present: true}}, Cluster: "c-debug"},
+		{ID: "no-token", Methods: []string{"GET"}, Prefix: "/public/", Query: []newmodel.QueryParamMatcher{{Name: "token", Absent: true}}, Cluster: "c-anon"},
+		{ID: "public", Methods: []string{"GET"}, Prefix: "/public/", Cluster: "c-public"},
+		{ID: "re-v2", Methods: []string{"GET"}, Regex: `/legacy/.+`, Query: []newmodel.QueryParamMatcher{{Name: "version", Values: []string{"2"}}}, Cluster: "c-legacy-v2"},
+		{ID: "hdr-q", Methods: []string{"GET"}, Headers: []HeaderSpec{{Name: "X-Env", Values: []string{"prod"}}}, Query: []newmodel.QueryParamMatcher{{Name: "canary", Present: true}}, Cluster: "c-canary"},
+		{ID: "q-only", Methods: []string{"GET"}, Query: []newmodel.QueryParamMatcher{{Name: "shadow", Values: []string{"1"}}}, Cluster: "c-shadow"},
+	}
+	newc := buildNew(specs)
+
+	cases := []struct {
+		name    string
+		url     string
+		hdr     map[string]string
+		ok      bool
+		cluster string
+	}{
+		{"exact", "/api/orders?version=2", nil, true, "c-v2"},
+		{"regex", "/api/orders?version=4", nil, true, "c-v3"},
+		{"multi.value", "/api/orders?version=1&version=2", nil, true, "c-v2"},
+		{"no.match", "/api/orders?version=1", nil, true, "c-orders"},
+		{"no.query", "/api/orders", nil, true, "c-orders"},
+		{"present.empty", "/api/users?debug", nil, true, "c-debug"},
+		{"present.missing", "/api/users", nil, false, ""},
+		{"absent", "/public/x", nil, true, "c-anon"},
+		{"absent.given", "/public/x?token=abc", nil, true, "c-public"},
+		{"regex.route", "/legacy/x?version=2", nil, true, "c-legacy-v2"},
+		{"regex.route.miss", "/legacy/x", nil, false, ""},
+		{"header.and.query", "/other?canary=1", map[string]string{"X-Env": "prod"}, true, "c-canary"},
+		{"header.without.query", "/other", map[string]string{"X-Env": "prod"}, false, ""},
+		{"query.only", "/anything?shadow=1", nil, true, "c-shadow"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", tc.url, nil)
+			for k, v := range tc.hdr {
+				req.Header.Set(k, v)
+			}
+			act, err := newc.Route(req)
+			if (err == nil) != tc.ok || (tc.ok && act.Cluster != tc.cluster) {
+				t.Fatalf("GET %s hdr=%v: want ok=%v %q, got %v %v", tc.url, tc.hdr, tc.ok, tc.cluster, act, err)
+			}
+		})
+	}
+
+	// the query string of the path is used by RouteByPathAndName
+	if act, err := newc.RouteByPathAndName("/api/orders?version=2", "GET"); err != nil || act.Cluster != "c-v2" {
+		t.Fatalf("RouteByPathAndName: %v %v", act, err)
+	}
+}
+
+// header-only routes are looked up by header value, the first route in priority and config order still wins
+func TestHeaderOnly_IndexKeepsFirstMatch(t *testing.T) {
+	specs := []RouteSpec{
+		{ID: "re", Methods: []string{"GET"}, Headers: []HeaderSpec{{Name: "X-Env", Values: []string{`^pro`}, Regex: true}}, Cluster: "c-re"},
+		{ID: "exact", Methods: []string{"GET"}, Headers: []HeaderSpec{{Name: "X-Env", Values: []string{"prod", "staging"}}}, Cluster: "c-exact"},
+		{ID: "two", Methods: []string{"GET"}, Headers: []HeaderSpec{{Name: "X-Team", Values: []string{"blue"}}, {Name: "X-Env", Values: []string{"qa"}}}, Cluster: "c-two"},
+		{ID: "query", Methods: []string{"GET"}, Query: []newmodel.QueryParamMatcher{{Name: "canary", Values: []string{"1"}}}, Cluster: "c-query"},
+		{ID: "post", Methods: []string{"POST"}, Headers: []HeaderSpec{{Name: "x-env", Values: []string{"dev"}}}, Cluster: "c-post"},
+		{ID: "fallback", Methods: []string{"GET", "POST"}, Prefix: "/", Cluster: "c-fallback"},
+	}
+	rs := make([]*newmodel.Router, 0, len(specs)+1)
+	for _, s := range specs {
+		rs = append(rs, s.toNew())
+	}
+	hi := RouteSpec{ID: "hi", Methods: []string{"GET"}, Headers: []HeaderSpec{{Name: "X-Env", Values: []string{"qa"}}}, Cluster: "c-hi"}.toNew()
+	hi.Priority = 5
+	rs = append(rs, hi)
+	newc := newrouter.CreateRouterCoordinator(&newmodel.RouteConfiguration{Routes: rs})
+
+	route := func(method, url string, hdr map[string]string) string {
+		req, _ := http.NewRequest(method, url, nil)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		act, err := newc.Route(req)
+		if err != nil {
+			t.Fatalf("%s %s hdr=%v: %v", method, url, hdr, err)
+		}
+		return act.Cluster
+	}
+	cases := []struct {
+		method, url string
+		hdr         map[string]string
+		cluster     string
+	}{
+		{"GET", "/", map[string]string{"X-Env": "prod"}, "c-re"},
+		{"GET", "/", map[string]string{"X-Env": "staging"}, "c-exact"},
+		{"GET", "/?canary=1", map[string]string{"X-Env": "staging"}, "c-exact"},
+		{"GET", "/?canary=1", nil, "c-query"},
+		{"GET", "/", map[string]string{"X-Env": "qa", "X-Team": "blue"}, "c-hi"},
+		{"GET", "/", map[string]string{"X-Env": "dev", "X-Team": "blue"}, "c-fallback"},
+		{"POST", "/", map[string]string{"X-Env": "dev"}, "c-post"},
+		{"GET", "/", map[string]string{"X-Env": "dev"}, "c-fallback"},
+		{"GET", "/", map[string]string{"X-Other": "prod"}, "c-fallback"},
+	}
+	for _, tc := range cases {
+		if got := route(tc.method, tc.url, tc.hdr); got != tc.cluster {
+			t.Fatalf("%s %s hdr=%v: want %s, got %s", tc.method, tc.url, tc.hdr, tc.cluster, got)
+		}
+	}
+
+	// the index follows incremental changes
+	newc.OnDeleteRouter(rs[0])
+	top := RouteSpec{ID: "top", Methods: []string{"GET"}, Headers: []HeaderSpec{{Name: "X-Team", Values: []string{"blue"}}}, Cluster: "c-top"}.toNew()
+	top.Priority = 10
+	newc.OnAddRouter(top)
+	flush(t, newc)
+	if got := route("GET", "/", map[string]string{"X-Env": "prod"}); got != "c-exact" {
+		t.Fatalf("after delete: want c-exact, got %s", got)
+	}
+	if got := route("GET", "/", map[string]string{"X-Env": "qa", "X-Team": "blue"}); got != "c-top" {
+		t.Fatalf("after add: want c-top, got %s", got)
+	}
+}
+
+func TestHeaderMatchers_Operators(t *testing.T) {
+	route := func(id, path string, hm newmodel.HeaderMatcher) *newmodel.Router {
+		return &newmodel.Router{
+			ID:    id,
+			Match: newmodel.RouterMatch{Methods: []string{"GET"}, Path: path, Headers: []newmodel.HeaderMatcher{hm}},
+			Route: newmodel.RouteAction{Cluster: "c-" + id},
+		}
+	}
+	routes := []*newmodel.Router{
+		route("present", "/present", newmodel.HeaderMatcher{Name: "Authorization", Present: true}),
+		route("absent", "/absent", newmodel.HeaderMatcher{Name: "authorization", Absent: true}),
+		route("prefix", "/prefix", newmodel.HeaderMatcher{Name: "Authorization", Prefix: "bearer ", IgnoreCase: true}),
+		route("suffix", "/suffix", newmodel.HeaderMatcher{Name: "X-Tenant", Suffix: ".eu"}),
+		route("contains", "/contains", newmodel.HeaderMatcher{Name: "User-Agent", Contains: "mobile", IgnoreCase: true}),
+		route("exact", "/exact", newmodel.HeaderMatcher{Name: "X-Env", Values: []string{"Prod"}, IgnoreCase: true}),
+		route("range", "/range", newmodel.HeaderMatcher{Name: "X-Version", Range: &newmodel.HeaderRange{Start: 2, End: 5}}),
+		route("invert", "/invert", newmodel.HeaderMatcher{Name: "X-Env", Values: []string{"prod"}, Invert: true}),
+		route("multi", "/multi", newmodel.HeaderMatcher{Name: "X-Tag", Values: []string{"b"}}),
+		{
+			ID:    "internal",
+			Match: newmodel.RouterMatch{Methods: []string{"POST"}, Headers: []newmodel.HeaderMatcher{{Name: "X-Internal", Absent: true, Invert: true}}},
+			Route: newmodel.RouteAction{Cluster: "c-internal"},
+		},
+		RouteSpec{ID: "fallback", Methods: []string{"GET", "POST"}, Prefix: "/", Cluster: "c-fallback"}.toNew(),
+	}
+	newc, err := newrouter.CreateValidatedRouterCoordinator(&newmodel.RouteConfiguration{Routes: routes})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		method, path string
+		hdr          http.Header
+		cluster      string
+	}{
+		{"GET", "/present", http.Header{"Authorization": {""}}, "c-present"},
+		{"GET", "/present", nil, "c-fallback"},
+		{"GET", "/absent", nil, "c-absent"},
+		{"GET", "/absent", http.Header{"Authorization": {"x"}}, "c-fallback"},
+		{"GET", "/prefix", http.Header{"Authorization": {"Bearer abc"}}, "c-prefix"},
+		{"GET", "/prefix", http.Header{"Authorization": {"Basic abc"}}, "c-fallback"},
+		{"GET", "/suffix", http.Header{"X-Tenant": {"acme.eu"}}, "c-suffix"},
+		{"GET", "/suffix", http.Header{"X-Tenant": {"acme.EU"}}, "c-fallback"},
+		{"GET", "/contains", http.Header{"User-Agent": {"Foo Mobile Safari"}}, "c-contains"},
+		{"GET", "/contains", http.Header{"User-Agent": {"curl"}}, "c-fallback"},
+		{"GET", "/exact", http.Header{"X-Env": {"PROD"}}, "c-exact"},
+		{"GET", "/range", http.Header{"X-Version": {"4"}}, "c-range"},
+		{"GET", "/range", http.Header{"X-Version": {"5"}}, "c-fallback"},
+		{"GET", "/range", http.Header{"X-Version": {"v3"}}, "c-fallback"},
+		{"GET", "/invert", http.Header{"X-Env": {"dev"}}, "c-invert"},
+		{"GET", "/invert", nil, "c-invert"},
+		{"GET", "/invert", http.Header{"X-Env": {"prod"}}, "c-fallback"},
+		{"GET", "/multi", http.Header{"X-Tag": {"a", "b"}}, "c-multi"},
+		{"GET", "/multi", http.Header{"X-Tag": {"a", "c"}}, "c-fallback"},
+		{"POST", "/any", http.Header{"X-Internal": {"1"}}, "c-internal"},
+		{"POST", "/any", nil, "c-fallback"},
+	}
+	for _, tc := range cases {
+		req, _ := http.NewRequest(tc.method, tc.path, nil)
+		req.Header = tc.hdr
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+		act, err := newc.Route(req)
+		if err != nil || act.Cluster != tc.cluster {
+			t.Fatalf("%s %s hdr=%v: want %s, got %v %v", tc.method, tc.path, tc.hdr, tc.cluster, act, err)
+		}
+		// RouterMatch.MatchHeader agrees with the coordinator
+		r := routes[0]
+		for _, r = range routes {
+			if r.Match.Path == tc.path || tc.method == "POST" && r.ID == "internal" {
+				break
+			}
+		}
+		if got := r.Match.MatchHeader(req); got != (tc.cluster == r.Route.Cluster) {
+			t.Fatalf("%s %s hdr=%v: MatchHeader of %s = %v", tc.method, tc.path, tc.hdr, r.ID, got)
+		}
+	}
+	if hm := (newmodel.HeaderMatcher{Name: "X-Version", Range: &newmodel.HeaderRange{Start: 2, End: 5}}); !hm.MatchValues("3") || hm.MatchValues("7") {
+		t.Fatal("MatchValues ignores the range")
+	}
+
+	errs := newmodel.ValidateRouter(route("bad", "/bad", newmodel.HeaderMatcher{Name: "X", Prefix: "a", Absent: true}))
+	errs = append(errs, newmodel.ValidateRouter(route("bad", "/bad", newmodel.HeaderMatcher{Name: "X", Range: &newmodel.HeaderRange{Start: 5, End: 5}}))...)
+	errs = append(errs, newmodel.ValidateRouter(route("bad", "/bad", newmodel.HeaderMatcher{Name: "X", Present: true, IgnoreCase: true}))...)
+	if len(errs) != 3 {
+		t.Fatalf("want 3 validation errors, got %v", errs)
+	}
+}
+
+func TestCookieMatchers(t *testing.T) {
+	route := func(id, path string, methods []string, cm newmodel.CookieMatcher) *newmodel.Router {
+		return &newmodel.Router{
+			ID:    id,
+			Match: newmodel.RouterMatch{Methods: methods, Path: path, Cookies: []newmodel.CookieMatcher{cm}},
+			Route: newmodel.RouteAction{Cluster: "c-" + id},
+		}
+	}
+	routes := []*newmodel.Router{
+		route("beta", "/feature", []string{"GET"}, newmodel.CookieMatcher{Name: "flag", Values: []string{"beta", "canary"}}),
+		route("user", "/users/:id", []string{"GET"}, newmodel.CookieMatcher{Name: "uid", Values: []string{"^[0-9]+$"}, Regex: true}),
+		route("session", "", []string{"POST"}, newmodel.CookieMatcher{Name: "session", Present: true}),
+		RouteSpec{ID: "fallback", Methods: []string{"GET", "POST"}, Prefix: "/", Cluster: "c-fallback"}.toNew(),
+	}
+	newc, err := newrouter.CreateValidatedRouterCoordinator(&newmodel.RouteConfiguration{Routes: routes})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		method, path, cookie string
+		cluster              string
+	}{
+		{"GET", "/feature", "flag=beta", "c-beta"},
+		{"GET", "/feature", "other=1; flag=canary", "c-beta"},
+		{"GET", "/feature", "flag=stable", "c-fallback"},
+		{"GET", "/feature", "flag=stable; flag=beta", "c-fallback"},
+		{"GET", "/feature", "", "c-fallback"},
+		{"GET", "/users/7", "uid=42", "c-user"},
+		{"GET", "/users/7", "uid=abc", "c-fallback"},
+		{"POST", "/any", "session=abc", "c-session"},
+		{"POST", "/any", "flag=beta", "c-fallback"},
+		{"GET", "/any", "session=abc", "c-fallback"},
+	}
+	for _, tc := range cases {
+		req, _ := http.NewRequest(tc.method, tc.path, nil)
+		if tc.cookie != "" {
+			req.Header.Set("Cookie", tc.cookie)
+		}
+		act, err := newc.Route(req)
+		if err != nil || act.Cluster != tc.cluster {
+			t.Fatalf("%s %s cookie=%q: want %s, got %v %v", tc.method, tc.path, tc.cookie, tc.cluster, act, err)
+		}
+	}
+	// no request, no cookie
+	if act, err := newc.RouteByPathAndName("/feature", "GET"); err != nil || act.Cluster != "c-fallback" {
+		t.Fatalf("RouteByPathAndName: want c-fallback, got %v %v", act, err)
+	}
+
+	errs := newmodel.ValidateRouter(route("bad", "/bad", nil, newmodel.CookieMatcher{Name: "flag", Values: []string{"beta"}, Present: true}))
+	errs = append(errs, newmodel.ValidateRouter(route("bad", "/bad", nil, newmodel.CookieMatcher{Name: "flag", Values: []string{"("}, Regex: true}))...)
+	errs = append(errs, newmodel.ValidateRouter(route("bad", "/bad", nil, newmodel.CookieMatcher{Present: true}))...)
+	if len(errs) != 3 {
+		t.Fatalf("want 3 validation errors, got %v", errs)
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	routes := func(prefix string, specs ...RouteSpec) []*newmodel.Router {
+		rs := make([]*newmodel.Router, 0, len(specs))
+		for _, s := range specs {
+			s.ID = prefix + "-" + s.ID
+			rs = append(rs, s.toNew())
+		}
+		return rs
+	}
+	orders := func(cluster string) RouteSpec {
+		return RouteSpec{ID: "orders", Methods: []string{"GET"}, Path: "/api/orders", Cluster: cluster}
+	}
+	cfg := &newmodel.RouteConfiguration{
+		Routes: routes("default", orders("c-default")),
+		VirtualHosts: []*newmodel.VirtualHost{
+			{Name: "acme", Domains: []string{"acme.example.com", "www.acme.example.com"}, Routes: routes("acme", orders("c-acme"),
+				RouteSpec{ID: "only", Methods: []string{"GET"}, Path: "/acme/only", Cluster: "c-acme-only"})},
+			{Name: "tenants", Domains: []string{"*.example.com"}, Routes: routes("tenants", orders("c-tenants"))},
+			{Name: "eu", Domains: []string{"*.eu.example.com"}, Routes: routes("eu", orders("c-eu"))},
+		},
+	}
+	newc := newrouter.CreateRouterCoordinator(cfg)
+
+	route := func(host, path string) string {
+		req, _ := http.NewRequest("GET", "http://placeholder"+path, nil)
+		req.Host = host
+		act, err := newc.Route(req)
+		if err != nil {
+			return "err"
+		}
+		return act.Cluster
+	}
+	cases := []struct{ host, path, cluster string }{
+		{"acme.example.com", "/api/orders", "c-acme"},
+		{"ACME.example.com:8080", "/api/orders", "c-acme"},
+		{"www.acme.example.com", "/api/orders", "c-acme"},
+		{"foo.example.com", "/api/orders", "c-tenants"},
+		{"foo.eu.example.com", "/api/orders", "c-eu"},
+		{"example.com", "/api/orders", "c-default"},
+		{"localhost:8888", "/api/orders", "c-default"},
+		{"[::1]:8888", "/api/orders", "c-default"},
+		// virtual hosts are isolated
+		{"foo.example.com", "/acme/only", "err"},
+		{"acme.example.com", "/acme/only", "c-acme-only"},
+	}
+	for _, tc := range cases {
+		if got := route(tc.host, tc.path); got != tc.cluster {
+			t.Fatalf("GET %s%s: want %q, got %q", tc.host, tc.path, tc.cluster, got)
+		}
+	}
+
+	// RouteByPathAndName takes the host of an absolute path
+	if act, err := newc.RouteByPathAndName("http://foo.eu.example.com/api/orders", "GET"); err != nil || act.Cluster != "c-eu" {
+		t.Fatalf("RouteByPathAndName absolute: %v %v", act, err)
+	}
+	if act, err := newc.RouteByPathAndName("/api/orders", "GET"); err != nil || act.Cluster != "c-default" {
+		t.Fatalf("RouteByPathAndName: %v %v", act, err)
+	}
+
+	// dynamic updates: a * virtual host replaces the default one, routes move between hosts, hosts go away
+	newc.OnAddVirtualHost(&newmodel.VirtualHost{Name: "any", Domains: []string{"*"}, Routes: routes("any", orders("c-any"))})
+	newc.OnAddVirtualHostRouter("tenants", RouteSpec{ID: "tenants-new", Methods: []string{"GET"}, Path: "/new", Cluster: "c-tenants-new"}.toNew())
+	newc.OnDeleteVirtualHost("eu")
+	newc.OnAddVirtualHost(&newmodel.VirtualHost{Name: "acme", Domains: []string{"acme.example.com"}, Routes: routes("acme", orders("c-acme-v2"))})
+	flush(t, newc)
+	cases = []struct{ host, path, cluster string }{
+		{"localhost", "/api/orders", "c-any"},
+		{"foo.eu.example.com", "/api/orders", "c-tenants"},
+		{"foo.example.com", "/new", "c-tenants-new"},
+		{"acme.example.com", "/api/orders", "c-acme-v2"},
+		{"acme.example.com", "/acme/only", "err"},
+		{"www.acme.example.com", "/api/orders", "c-tenants"},
+	}
+	for _, tc := range cases {
+		if got := route(tc.host, tc.path); got != tc.cluster {
+			t.Fatalf("after update, GET %s%s: want %q, got %q", tc.host, tc.path, tc.cluster, got)
+		}
+	}
+}
+
+// fixedWeights always draws the same value, hashes like the default source
+type fixedWeights struct{ v uint64 }
+
+func (f fixedWeights) Random(n uint64) uint64 { return f.v % n }
+func (f fixedWeights) Hash(key string, n uint64) uint64 {
+	return newmodel.DefaultWeightSource().Hash(key, n)
+}
+
+func TestWeightedClusters(t *testing.T) {
+	split := func(spec RouteSpec, wc newmodel.WeightedClusters) *newmodel.Router {
+		r := spec.toNew()
+		r.Route.WeightedClusters = &wc
+		return r
+	}
+	canary := newmodel.WeightedClusters{Clusters: []newmodel.WeightedCluster{{Name: "stable", Weight: 90}, {Name: "canary", Weight: 10}}, TotalWeight: 100}
+	byHeader := canary
+	byHeader.HashHeader = "X-User"
+	byCookie := canary
+	byCookie.HashCookie = "uid"
+	routes := []*newmodel.Router{
+		split(RouteSpec{ID: "random", Methods: []string{"GET"}, Path: "/random"}, canary),
+		split(RouteSpec{ID: "header", Methods: []string{"GET"}, Path: "/header"}, byHeader),
+		split(RouteSpec{ID: "cookie", Methods: []string{"GET"}, Path: "/cookie"}, byCookie),
+		split(RouteSpec{ID: "bad-total", Methods: []string{"GET"}, Path: "/bad/total"}, newmodel.WeightedClusters{Clusters: []newmodel.WeightedCluster{{Name: "a", Weight: 50}}, TotalWeight: 100}),
+		split(RouteSpec{ID: "bad-zero", Methods: []string{"GET"}, Path: "/bad/zero"}, newmodel.WeightedClusters{Clusters: []newmodel.WeightedCluster{{Name: "a"}, {Name: "b"}}}),
+		split(RouteSpec{ID: "bad-dup", Methods: []string{"GET"}, Regex: `/bad/dup`}, newmodel.WeightedClusters{Clusters: []newmodel.WeightedCluster{{Name: "a", Weight: 1}, {Name: "a", Weight: 1}}}),
+		RouteSpec{ID: "fallback", Methods: []string{"GET"}, Prefix: "/", Cluster: "c-fallback"}.toNew(),
+	}
+	newc := newrouter.CreateRouterCoordinator(&newmodel.RouteConfiguration{Routes: routes})
+
+	get := func(path string, set func(*http.Request)) string {
+		req, _ := http.NewRequest("GET", path, nil)
+		if set != nil {
+			set(req)
+		}
+		act, err := newc.Route(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		return act.Cluster
+	}
+
+	// random split follows the weights
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		counts[get("/random", nil)]++
+	}
+	if counts["canary"] < 700 || counts["canary"] > 1300 || counts["stable"]+counts["canary"] != 10000 {
+		t.Fatalf("90/10 split: %v", counts)
+	}
+
+	// a pluggable source decides the random side
+	newc.SetWeightSource(fixedWeights{v: 95})
+	if got := get("/random", nil); got != "canary" {
+		t.Fatalf("fixed source 95: %q", got)
+	}
+	newc.SetWeightSource(fixedWeights{v: 0})
+	if got := get("/random", nil); got != "stable" {
+		t.Fatalf("fixed source 0: %q", got)
+	}
+	if m, err := newc.MatchRouteByPathAndName("/random", "GET"); err != nil || m.Action.Cluster != "stable" {
+		t.Fatalf("MatchRouteByPathAndName: %v %v", m, err)
+	}
+	// the source may be replaced while requests are routed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			newc.SetWeightSource(fixedWeights{v: uint64(i)})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		get("/random", nil)
+	}
+	<-done
+
+	// sticky: the same user always lands on the same side, users are spread over both sides
+	newc.SetWeightSource(newmodel.DefaultWeightSource())
+	for _, c := range []struct {
+		path string
+		set  func(req *http.Request, user string)
+	}{
+		{"/header", func(req *http.Request, user string) { req.Header.Set("X-User", user) }},
+		{"/cookie", func(req *http.Request, user string) { req.AddCookie(&http.Cookie{Name: "uid", Value: user}) }},
+	} {
+		sides := map[string]int{}
+		for u := 0; u < 500; u++ {
+			user := "user-" + strconv.Itoa(u)
+			first := get(c.path, func(req *http.Request) { c.set(req, user) })
+			for i := 0; i < 5; i++ {
+				if got := get(c.path, func(req *http.Request) { c.set(req, user) }); got != first {
+					t.Fatalf("%s %s: not sticky, %q then %q", c.path, user, first, got)
+				}
+			}
+			sides[first]++
+		}
+		if sides["canary"] == 0 || sides["stable"] == 0 {
+			t.Fatalf("%s: all users on one side: %v", c.path, sides)
+		}
+	}
+
+	// routes with invalid weights are not served
+	for _, path := range []string{"/bad/total", "/bad/zero", "/bad/dup"} {
+		if got := get(path, nil); got != "c-fallback" {
+			t.Fatalf("GET %s: want c-fallback, got %q", path, got)
+		}
+	}
+}
+
+func TestRouteActions_RedirectAndDirectResponse(t *testing.T) {
+	with := func(spec RouteSpec, set func(a *newmodel.RouteAction)) *newmodel.Router {
+		r := spec.toNew()
+		set(&r.Route)
+		return r
+	}
+	routes := []*newmodel.Router{
+		with(RouteSpec{ID: "https", Prefix: "/"}, func(a *newmodel.RouteAction) {
+			a.Redirect = &newmodel.RedirectAction{Scheme: "https"}
+		}),
+		with(RouteSpec{ID: "moved", Methods: []string{"GET"}, Path: "/old/page"}, func(a *newmodel.RouteAction) {
+			a.Redirect = &newmodel.RedirectAction{Host: "new.example.com", Path: "/page", StripQuery: true, ResponseCode: http.StatusPermanentRedirect}
+		}),
+		with(RouteSpec{ID: "maintenance", Prefix: "/shop/"}, func(a *newmodel.RouteAction) {
+			a.DirectResponse = &newmodel.DirectResponseAction{Status: http.StatusServiceUnavailable, Body: "down for maintenance", Headers: map[string]string{"Retry-After": "120"}}
+		}),
+		with(RouteSpec{ID: "both", Methods: []string{"GET"}, Path: "/shop/both"}, func(a *newmodel.RouteAction) {
+			a.Redirect = &newmodel.RedirectAction{Path: "/x"}
+			a.DirectResponse = &newmodel.DirectResponseAction{}
+		}),
+		with(RouteSpec{ID: "bad-code", Methods: []string{"GET"}, Path: "/shop/bad"}, func(a *newmodel.RouteAction) {
+			a.Redirect = &newmodel.RedirectAction{Path: "/x", ResponseCode: http.StatusOK}
+		}),
+		RouteSpec{ID: "api", Methods: []string{"GET"}, Prefix: "/api/", Cluster: "c-api"}.toNew(),
+	}
+	newc := newrouter.CreateRouterCoordinator(&newmodel.RouteConfiguration{Routes: routes})
+
+	serve := func(method, url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		act, err := newc.Route(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+		rec := httptest.NewRecorder()
+		if !act.Respond(rec, req) {
+			rec.Code = -1 // forwarded
+			rec.Body.WriteString(act.Cluster)
+		}
+		return rec
+	}
+
+	rec := serve("GET", "http://shop.example.com:80/cart?id=1")
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "https://shop.example.com/cart?id=1" {
+		t.Fatalf("https redirect: %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	rec = serve("GET", "http://old.example.com/old/page?utm=x")
+	if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != "http://new.example.com/page" {
+		t.Fatalf("moved: %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	rec = serve("GET", "http://shop.example.com/shop/cart")
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "down for maintenance" || rec.Header().Get("Retry-After") != "120" {
+		t.Fatalf("maintenance: %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+	if rec = serve("HEAD", "http://shop.example.com/shop/cart"); rec.Code != http.StatusServiceUnavailable || rec.Body.Len() != 0 {
+		t.Fatalf("maintenance HEAD: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec = serve("GET", "http://shop.example.com/api/orders"); rec.Code != -1 || rec.Body.String() != "c-api" {
+		t.Fatalf("cluster: %d %q", rec.Code, rec.Body.String())
+	}
+	// invalid actions are not served, the request falls through to the next route
+	for _, url := range []string{"http://shop.example.com/shop/both", "http://shop.example.com/shop/bad"} {
+		if rec = serve("GET", url); rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("%s: want the maintenance prefix, got %d", url, rec.Code)
+		}
+	}
+}
+
+func TestRouteActions_Rewrite(t *testing.T) {
+	with := func(spec RouteSpec, set func(a *newmodel.RouteAction)) *newmodel.Router {
+		r := spec.toNew()
+		r.Route.Cluster = "c-" + spec.ID
+		set(&r.Route)
+		return r
+	}
+	routes := []*newmodel.Router{
+		with(RouteSpec{ID: "orders", Methods: []string{"GET"}, Prefix: "/api/v1/orders/"}, func(a *newmodel.RouteAction) { a.PrefixRewrite = "/orders/" }),
+		with(RouteSpec{ID: "strip", Methods: []string{"GET"}, Prefix: "/svc/:name"}, func(a *newmodel.RouteAction) { a.PrefixRewrite = "/" }),
+		with(RouteSpec{ID: "health", Methods: []string{"GET"}, Path: "/healthz"}, func(a *newmodel.RouteAction) { a.PrefixRewrite = "/actuator/health" }),
+		with(RouteSpec{ID: "users", Methods: []string{"GET"}, Path: "/users/:id/profile"}, func(a *newmodel.RouteAction) {
+			a.RegexRewrite = &newmodel.RegexRewrite{Pattern: `^/users/([^/]+)/profile$`, Substitution: "/v2/profiles/$1?by={id}"}
+		}),
+		with(RouteSpec{ID: "reports", Methods: []string{"GET"}, Regex: `/reports/(?P<year>\d{4})/(?P<month>\d{2})`}, func(a *newmodel.RouteAction) {
+			a.RegexRewrite = &newmodel.RegexRewrite{Pattern: `^/reports/.*$`, Substitution: "/archive/{year}-{month}"}
+		}),
+		with(RouteSpec{ID: "groups", Methods: []string{"GET"}, Regex: `/r/(?P<year>\d{4})`}, func(a *newmodel.RouteAction) {
+			a.RegexRewrite = &newmodel.RegexRewrite{Pattern: `^/r/(?P<year>\d{4})$`, Substitution: "/reports/${year}"}
+		}),
+		with(RouteSpec{ID: "u", Methods: []string{"GET"}, Path: "/u/:id"}, func(a *newmodel.RouteAction) {
+			a.RegexRewrite = &newmodel.RegexRewrite{Pattern: `^/u/(?P<id>[^/]+)$`, Substitution: "/users/${id}/$${id}"}
+		}),
+		with(RouteSpec{ID: "plain", Methods: []string{"GET"}, Prefix: "/plain/"}, func(a *newmodel.RouteAction) {}),
+		with(RouteSpec{ID: "bad", Methods: []string{"GET"}, Path: "/plain/bad"}, func(a *newmodel.RouteAction) {
+			a.RegexRewrite = &newmodel.RegexRewrite{Pattern: `(`, Substitution: "/x"}
+		}),
+	}
+	newc := newrouter.CreateRouterCoordinator(&newmodel.RouteConfiguration{Routes: routes})
+
+	cases := []struct{ path, route, upstream string }{
+		{"/api/v1/orders/42", "orders", "/orders/42"},
+		{"/api/v1/orders/42/items?x=1", "orders", "/orders/42/items"},
+		{"/api/v1/orders", "orders", "/orders/"},
+		{"/svc/billing/invoices/7", "strip", "/invoices/7"},
+		{"/healthz", "health", "/actuator/health"},
+		{"/users/7/profile", "users", "/v2/profiles/7?by=7"},
+		{"/reports/2024/05", "reports", "/archive/2024-05"},
+		{"/r/2024", "groups", "/reports/2024"},
+		{"/u/7", "u", "/users/7/$7"},
+		{"/plain/a/b", "plain", "/plain/a/b"},
+		{"/plain/bad", "plain", "/plain/bad"},
+	}
+	for _, tc := range cases {
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		m, err := newc.MatchRoute(req)
+		if err != nil || m.RouteID != tc.route || m.Path != tc.upstream {
+			t.Fatalf("GET %s: want %s %q, got %v %v", tc.path, tc.route, tc.upstream, m, err)
+		}
+		m, err = newc.MatchRouteByPathAndName("http://example.com"+tc.path, "GET")
+		if err != nil || m.RouteID != tc.route || m.Path != tc.upstream {
+			t.Fatalf("by path %s: want %s %q, got %v %v", tc.path, tc.route, tc.upstream, m, err)
+		}
+	}
+}
+
+func TestPrecedence_PriorityAndConflicts(t *testing.T) {
+	prio := func(s RouteSpec, p int) *newmodel.Router {
+		r := s.toNew()
+		r.Priority = p
+		return r
+	}
+	get := func(s RouteSpec) *newmodel.Router { return prio(s, 0) }
+	hx := []HeaderSpec{{Name: "X", Values: []string{"1"}}}
+	hy := []HeaderSpec{{Name: "Y", Values: []string{"1"}}}
+	routes := []*newmodel.Router{
+		get(RouteSpec{ID: "a", Methods: []string{"GET"}, Path: "/x", Cluster: "c-a"}),
+		prio(RouteSpec{ID: "b", Methods: []string{"GET"}, Path: "/x", Cluster: "c-b"}, 10),
+		get(RouteSpec{ID: "c", Methods: []string{"GET"}, Path: "/y/:id", Cluster: "c-c"}),
+		get(RouteSpec{ID: "d", Methods: []string{"GET"}, Path: "/y/:name", Cluster: "c-d"}),
+		get(RouteSpec{ID: "e", Methods: []string{"GET"}, Path: "/z", Headers: hx, Cluster: "c-e"}),
+		get(RouteSpec{ID: "f", Methods: []string{"GET"}, Path: "/z", Cluster: "c-f"}),
+		get(RouteSpec{ID: "g", Methods: []string{"GET"}, Path: "/z", Cluster: "c-g"}),
+		get(RouteSpec{ID: "h", Methods: []string{"GET"}, Path: "/z", Headers: hy, Cluster: "c-h"}),
+		prio(RouteSpec{ID: "i", Methods: []string{"GET"}, Path: "/z", Headers: hy, Cluster: "c-i"}, -1),
+		get(RouteSpec{ID: "hdr-1", Methods: []string{"GET"}, Headers: []HeaderSpec{{Name: "X-Env", Values: []string{"prod"}}}, Cluster: "c-hdr-1"}),
+		prio(RouteSpec{ID: "hdr-2", Methods: []string{"GET"}, Headers: []HeaderSpec{{Name: "X-Env", Values: []string{"prod"}}}, Cluster: "c-hdr-2"}, 5),
+	}
+	newc := newrouter.CreateRouterCoordinator(&newmodel.RouteConfiguration{Routes: routes})
+
+	for _, tc := range []struct {
+		path    string
+		hdr     map[string]string
+		cluster string
+	}{
+		{"/x", nil, "c-b"},
+		{"/y/1", nil, "c-c"},
+		{"/z", map[string]string{"Y": "1"}, "c-h"},
+		{"/z", nil, "c-f"},
+		{"/other", map[string]string{"X-Env": "prod"}, "c-hdr-2"},
+	} {
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		for k, v := range tc.hdr {
+			req.Header.Set(k, v)
+		}
+		if act, err := newc.Route(req); err != nil || act.Cluster != tc.cluster {
+			t.Fatalf("GET %s %v: want %q, got %v %v", tc.path, tc.hdr, tc.cluster, act, err)
+		}
+	}
+
+	want := []newmodel.Conflict{
+		{Key: newmodel.TrieKey{Method: "GET", Key: "GET/x"}, Winner: "b", Shadowed: []string{"a"}},
+		{Key: newmodel.TrieKey{Method: "GET", Key: "GET/y/:_"}, Winner: "c", Duplicates: []string{"d"}},
+		{Key: newmodel.TrieKey{Method: "GET", Key: "GET/z"}, Winner: "e", Shadowed: []string{"i"}, Duplicates: []string{"g"}},
+	}
+	if got := newc.Conflicts(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("conflicts:\n got %+v\nwant %+v", got, want)
+	}
+
+	// incremental: conflicts follow the published routes
+	newc.OnDeleteRouter(routes[0])
+	newc.OnDeleteRouter(routes[3])
+	flush(t, newc)
+	if got := newc.Conflicts(); len(got) != 1 || got[0].Winner != "e" {
+		t.Fatalf("conflicts after delete: %+v", got)
+	}
+}
+
+// routes added in one publish window claim a path in the order they were added, whatever the map order
+func TestPrecedence_IncrementalInsertionOrder(t *testing.T) {
+	for round := 0; round < 10; round++ {
+		newc := buildNew(nil)
+		for i := 0; i < 20; i++ {
+			newc.OnAddRouter(RouteSpec{ID: "batch-" + strconv.Itoa(i), Methods: []string{"GET"}, Path: "/batch", Cluster: "c-" + strconv.Itoa(i)}.toNew())
+			newc.OnAddRouter(RouteSpec{ID: "hdr-" + strconv.Itoa(i), Methods: []string{"GET"}, Headers: []HeaderSpec{{Name: "X-Env", Values: []string{"prod"}}}, Cluster: "c-hdr-" + strconv.Itoa(i)}.toNew())
+		}
+		// a route deleted and added again goes last
+		newc.OnDeleteRouter(RouteSpec{ID: "batch-0"}.toNew())
+		newc.OnAddRouter(RouteSpec{ID: "batch-0", Methods: []string{"GET"}, Path: "/batch", Cluster: "c-0"}.toNew())
+		flush(t, newc)
+
+		if act, err := newc.RouteByPathAndName("/batch", "GET"); err != nil || act.Cluster != "c-1" {
+			t.Fatalf("round %d: want c-1, got %v %v", round, act, err)
+		}
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Env", "prod")
+		if act, err := newc.Route(req); err != nil || act.Cluster != "c-hdr-0" {
+			t.Fatalf("round %d: want c-hdr-0, got %v %v", round, act, err)
+		}
+	}
+}
+
+func TestPrecedence_ExtremePriorities(t *testing.T) {
+	prio := func(s RouteSpec, p int) *newmodel.Router {
+		r := s.toNew()
+		r.Priority = p
+		return r
+	}
+	hdr := []HeaderSpec{{Name: "X-Env", Values: []string{"prod"}}}
+	newc := newrouter.CreateRouterCoordinator(&newmodel.RouteConfiguration{Routes: []*newmodel.Router{
+		prio(RouteSpec{ID: "low", Methods: []string{"GET"}, Path: "/x", Cluster: "c-low"}, math.MinInt),
+		prio(RouteSpec{ID: "high", Methods: []string{"GET"}, Path: "/x", Cluster: "c-high"}, 1),
+		prio(RouteSpec{ID: "hdr-low", Methods: []string{"GET"}, Headers: hdr, Cluster: "c-hdr-low"}, math.MinInt),
+		prio(RouteSpec{ID: "hdr-high", Methods: []string{"GET"}, Headers: hdr, Cluster: "c-hdr-high"}, math.MaxInt),
+	}})
+	if act, err := newc.RouteByPathAndName("/x", "GET"); err != nil || act.Cluster != "c-high" {
+		t.Fatalf("want c-high, got %v %v", act, err)
+	}
+	req, _ := http.NewRequest("GET", "/y", nil)
+	req.Header.Set("X-Env", "prod")
+	if act, err := newc.Route(req); err != nil || act.Cluster != "c-hdr-high" {
+		t.Fatalf("want c-hdr-high, got %v %v", act, err)
+	}
+}
+
+// a header-only or regex route fixed after it failed to compile takes its insertion order back, as in a full build
+func TestPrecedence_FixedScanRouteMatchesFullBuild(t *testing.T) {
+	hdr := func(id, value string, regex bool) RouteSpec {
+		return RouteSpec{ID: id, Methods: []string{"GET"}, Headers: []HeaderSpec{{Name: "X-Env", Values: []string{value}, Regex: regex}}, Cluster: "c-" + id}
+	}
+	re := func(id, regex string) RouteSpec {
+		return RouteSpec{ID: id, Methods: []string{"GET"}, Regex: regex, Cluster: "c-" + id}
+	}
+	config := func(h1, r1 RouteSpec) *newmodel.RouteConfiguration {
+		return &newmodel.RouteConfiguration{
+			Routes: []*newmodel.Router{hdr("d1", "prod", false).toNew(), re("d2", "/d/.*").toNew()},
+			VirtualHosts: []*newmodel.VirtualHost{{Name: "api", Domains: []string{"api.example.com"}, Routes: []*newmodel.Router{
+				h1.toNew(), hdr("h2", "prod", false).toNew(), r1.toNew(), re("r2", "/legacy/.*").toNew(),
+			}}},
+		}
+	}
+	incr := newrouter.CreateRouterCoordinator(config(hdr("h1", "(prod", true), re("r1", "/legacy/(")))
+	incr.OnAddVirtualHostRouter("api", hdr("h1", "prod", false).toNew())
+	incr.OnAddVirtualHostRouter("api", re("r1", "/legacy/.*").toNew())
+	flush(t, incr)
+	full := newrouter.CreateRouterCoordinator(config(hdr("h1", "prod", false), re("r1", "/legacy/.*")))
+
+	for _, path := range []string{"/any", "/legacy/x"} {
+		for _, env := range []string{"prod", ""} {
+			req, _ := http.NewRequest("GET", path, nil)
+			req.Host = "api.example.com"
+			if env != "" {
+				req.Header.Set("X-Env", env)
+			}
+			ia, ie := incr.Route(req)
+			fa, fe := full.Route(req)
+			if (ie == nil) != (fe == nil) || (ie == nil && ia.Cluster != fa.Cluster) {
+				t.Fatalf("GET %s X-Env=%q: incremental={%v %v} full={%v %v}", path, env, ia, ie, fa, fe)
+			}
+		}
+	}
+	req, _ := http.NewRequest("GET", "/legacy/x", nil)
+	req.Host = "api.example.com"
+	req.Header.Set("X-Env", "prod")
+	if act, err := incr.Route(req); err != nil || act.Cluster != "c-h1" {
+		t.Fatalf("want c-h1, got %v %v", act, err)
+	}
+	req.Header.Del("X-Env")
+	if act, err := incr.Route(req); err != nil || act.Cluster != "c-r1" {
+		t.Fatalf("want c-r1, got %v %v", act, err)
+	}
+}
+
 func TestHeaderRegex_WithRoutes(t *testing.T) {
 	specs := []RouteSpec{
 		{ID: "hdr", Methods: []string{"GET"}, Headers: []HeaderSpec{{Name: "X-Env", Values: []string{"^prod|staging$"}, Regex: true}}, Cluster: "c-hdr"},
@@ -272,6 +1251,655 @@ func TestHeaderRegex_WithRoutes(t *testing.T) {
 	assertSame(t, oldc, newc, "GET", "/api/foo", map[string]string{"X-Env": "dev"}, true, "c-pre")
 }
 
+func TestValidation_StructuredErrors(t *testing.T) {
+	cases := []struct {
+		name  string
+		spec  RouteSpec
+		field string
+		fatal bool
+	}{
+		{"header.regex", RouteSpec{ID: "r", Methods: []string{"GET"}, Path: "/a", Headers: []HeaderSpec{{Name: "X-Env", Values: []string{"(prod"}, Regex: true}}, Cluster: "c"}, "match.headers[0].values", true},
+		{"matchall.mid.path", RouteSpec{ID: "r", Methods: []string{"GET"}, Path: "/a/**/b", Cluster: "c"}, "match.path", true},
+		{"unknown.method", RouteSpec{ID: "r", Methods: []string{"GET", "FETCH"}, Path: "/a", Cluster: "c"}, "match.methods[1]", false},
+		{"empty.cluster", RouteSpec{ID: "r", Methods: []string{"GET"}, Path: "/a"}, "route.cluster", false},
+		{"path.regex", RouteSpec{ID: "r", Methods: []string{"GET"}, Regex: "/a/(", Cluster: "c"}, "match.regex", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			errs := newmodel.ValidateRouter(tc.spec.toNew())
+			if len(errs) != 1 || errs[0].Field != tc.field || errs[0].RouteID != "r" || errs[0].Fatal != tc.fatal {
+				t.Fatalf("want one error on %s, fatal=%v, got %v", tc.field, tc.fatal, errs)
+			}
+		})
+	}
+	if errs := newmodel.ValidateRouter(RouteSpec{ID: "ok", Methods: []string{"GET"}, Path: "/a/{id}/**", Cluster: "c"}.toNew()); len(errs) != 0 {
+		t.Fatalf("valid route rejected: %v", errs)
+	}
+
+	cfg := &newmodel.RouteConfiguration{
+		Routes: []*newmodel.Router{RouteSpec{ID: "dup", Methods: []string{"GET"}, Path: "/a", Cluster: "c"}.toNew()},
+		VirtualHosts: []*newmodel.VirtualHost{
+			{Name: "api", Domains: []string{"api.example.com", "a*.example.com"}, Routes: []*newmodel.Router{
+				RouteSpec{ID: "dup", Methods: []string{"GET"}, Path: "/b", Cluster: "c"}.toNew(),
+			}},
+		},
+	}
+	var errs newmodel.ValidationErrors
+	if err := newmodel.ValidateConfig(cfg); !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("want the bad wildcard and the duplicated id, got %v", err)
+	}
+	if _, err := newrouter.CreateValidatedRouterCoordinator(cfg); err == nil {
+		t.Fatal("invalid config accepted")
+	}
+}
+
+func TestValidation_LenientDropsInvalidRoutes(t *testing.T) {
+	specs := []RouteSpec{
+		{ID: "guarded", Methods: []string{"GET"}, Prefix: "/admin/", Headers: []HeaderSpec{{Name: "X-Role", Values: []string{"(admin"}, Regex: true}}, Cluster: "c-admin"},
+		{ID: "hdr", Methods: []string{"GET"}, Headers: []HeaderSpec{{Name: "X-Env", Values: []string{"(prod"}, Regex: true}}, Cluster: "c-hdr"},
+		{ID: "pre", Methods: []string{"GET"}, Prefix: "/", Cluster: "c-pre"},
+	}
+	newc := buildNew(specs)
+	if newc.LastPublishError() == nil {
+		t.Fatal("want the invalid routes reported")
+	}
+	// the typo must not turn the guards into presence checks
+	for _, hdr := range []map[string]string{{"X-Role": "guest"}, {"X-Env": "dev"}} {
+		req, _ := http.NewRequest("GET", "/admin/users", nil)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		if act, err := newc.Route(req); err != nil || act.Cluster != "c-pre" {
+			t.Fatalf("%v: want c-pre, got %v %v", hdr, act, err)
+		}
+	}
+
+	newc.OnAddRouter(RouteSpec{ID: "bad", Methods: []string{"GET"}, Path: "/bad/**/x", Cluster: "c-bad"}.toNew())
+	newc.OnAddRouter(RouteSpec{ID: "good", Methods: []string{"GET"}, Path: "/good", Cluster: "c-good"}.toNew())
+	flush(t, newc)
+	var errs newmodel.ValidationErrors
+	if err := newc.LastPublishError(); !errors.As(err, &errs) || len(errs) != 1 || errs[0].RouteID != "bad" {
+		t.Fatalf("want the error of route bad, got %v", err)
+	}
+	if act, err := newc.RouteByPathAndName("/good", "GET"); err != nil || act.Cluster != "c-good" {
+		t.Fatalf("valid route not published: %v %v", act, err)
+	}
+}
+
+// lenient mode keeps serving what the baseline router served: routes without id or cluster, or with unknown methods,
+// are reported by LastPublishError but stay in the snapshot
+func TestValidation_LenientServesBaselineRoutes(t *testing.T) {
+	specs := []RouteSpec{
+		{ID: "", Methods: []string{"GET"}, Path: "/no-id", Cluster: "c-no-id"},
+		{ID: "no-cluster", Methods: []string{"GET"}, Path: "/no-cluster"},
+		{ID: "fetch", Methods: []string{"GET", "FETCH"}, Path: "/fetch", Cluster: "c-fetch"},
+	}
+	oldc, newc := buildOld(specs), buildNew(specs)
+	var errs newmodel.ValidationErrors
+	if err := newc.LastPublishError(); !errors.As(err, &errs) || len(errs) != 3 || len(errs.Fatal()) != 0 {
+		t.Fatalf("want three non fatal errors, got %v", err)
+	}
+	assertSame(t, oldc, newc, "GET", "/no-id", nil, true, "c-no-id")
+	assertSame(t, oldc, newc, "GET", "/no-cluster", nil, true, "")
+	assertSame(t, oldc, newc, "GET", "/fetch", nil, true, "c-fetch")
+	assertSame(t, oldc, newc, "FETCH", "/fetch", nil, true, "c-fetch")
+
+	newc.OnAddRouter(RouteSpec{ID: "purge", Methods: []string{"PURGE"}, Path: "/cache", Cluster: "c-cache"}.toNew())
+	flush(t, newc)
+	if err := newc.LastPublishError(); !errors.As(err, &errs) || len(errs) != 1 || errs[0].Field != "match.methods[0]" {
+		t.Fatalf("want the unknown method reported, got %v", err)
+	}
+	if act, err := newc.RouteByPathAndName("/cache", "PURGE"); err != nil || act.Cluster != "c-cache" {
+		t.Fatalf("want c-cache, got %v %v", act, err)
+	}
+}
+
+func TestValidation_StrictRejectsInvalidUpdates(t *testing.T) {
+	cfg := &newmodel.RouteConfiguration{
+		Routes: []*newmodel.Router{
+			RouteSpec{ID: "orders", Methods: []string{"GET"}, Path: "/orders", Cluster: "c-orders"}.toNew(),
+		},
+		VirtualHosts: []*newmodel.VirtualHost{
+			{Name: "api", Domains: []string{"api.example.com"}, Routes: []*newmodel.Router{
+				RouteSpec{ID: "api-users", Methods: []string{"GET"}, Path: "/users", Cluster: "c-api"}.toNew(),
+			}},
+		},
+	}
+	newc, err := newrouter.CreateValidatedRouterCoordinator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newc.LastPublishError() != nil {
+		t.Fatalf("unexpected error %v", newc.LastPublishError())
+	}
+	expect := func(host, path, cluster string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Host = host
+		act, err := newc.Route(req)
+		if cluster == "" {
+			if err == nil {
+				t.Fatalf("%s%s: want no match, got %s", host, path, act.Cluster)
+			}
+			return
+		}
+		if err != nil || act.Cluster != cluster {
+			t.Fatalf("%s%s: want %s, got %v %v", host, path, cluster, act, err)
+		}
+	}
+
+	// one invalid route rejects the whole batch
+	newc.OnAddRouter(RouteSpec{ID: "orders", Methods: []string{"GET"}, Path: "/orders", Cluster: "c-orders-v2"}.toNew())
+	newc.OnAddRouter(RouteSpec{ID: "new", Methods: []string{"GET"}, Path: "/new", Cluster: "c-new"}.toNew())
+	newc.OnAddRouter(RouteSpec{ID: "bad", Methods: []string{"GET"}, Path: "/bad", Headers: []HeaderSpec{{Name: "X-A", Values: []string{"[a"}, Regex: true}}, Cluster: "c-bad"}.toNew())
+	newc.OnAddVirtualHost(&newmodel.VirtualHost{Name: "api", Domains: []string{"api.example.com"}})
+	flush(t, newc)
+	var errs newmodel.ValidationErrors
+	if err := newc.LastPublishError(); !errors.As(err, &errs) || len(errs) != 1 || errs[0].RouteID != "bad" {
+		t.Fatalf("want the error of route bad, got %v", err)
+	}
+	expect("", "/orders", "c-orders")
+	expect("", "/new", "")
+	expect("api.example.com", "/users", "c-api")
+
+	// an invalid virtual host is rejected as well
+	newc.OnAddVirtualHost(&newmodel.VirtualHost{Name: "web", Domains: []string{"api.example.com"}})
+	flush(t, newc)
+	if newc.LastPublishError() == nil {
+		t.Fatal("want the reused domain reported")
+	}
+
+	// the rejected changes are gone, the next valid update is published on top of the active snapshot
+	newc.OnAddRouter(RouteSpec{ID: "next", Methods: []string{"GET"}, Path: "/next", Cluster: "c-next"}.toNew())
+	flush(t, newc)
+	if err := newc.LastPublishError(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expect("", "/next", "c-next")
+	expect("", "/new", "")
+	expect("", "/orders", "c-orders")
+	expect("api.example.com", "/users", "c-api")
+}
+
+func TestSnapshotVersions_Rollback(t *testing.T) {
+	newc := buildNew([]RouteSpec{
+		{ID: "orders", Methods: []string{"GET"}, Path: "/orders", Cluster: "c-orders"},
+	})
+	if v := newc.Version(); v != 1 {
+		t.Fatalf("want version 1, got %d", v)
+	}
+	expect := func(path, cluster string) {
+		t.Helper()
+		act, err := newc.RouteByPathAndName(path, "GET")
+		if cluster == "" {
+			if err == nil {
+				t.Fatalf("%s: want no match, got %s", path, act.Cluster)
+			}
+			return
+		}
+		if err != nil || act.Cluster != cluster {
+			t.Fatalf("%s: want %s, got %v %v", path, cluster, act, err)
+		}
+	}
+
+	// v2: a bad push replacing orders and adding users
+	newc.OnAddRouter(RouteSpec{ID: "orders", Methods: []string{"GET"}, Path: "/orders", Cluster: "c-broken"}.toNew())
+	newc.OnAddRouter(RouteSpec{ID: "users", Methods: []string{"GET"}, Path: "/users", Cluster: "c-users"}.toNew())
+	flush(t, newc)
+	// v3
+	newc.OnDeleteRouter(RouteSpec{ID: "users"}.toNew())
+	newc.OnAddRouter(RouteSpec{ID: "items", Methods: []string{"GET"}, Path: "/items", Cluster: "c-items"}.toNew())
+	flush(t, newc)
+	if v := newc.Version(); v != 3 {
+		t.Fatalf("want version 3, got %d", v)
+	}
+
+	if err := newc.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+	if v := newc.Version(); v != 4 {
+		t.Fatalf("a rollback is published as a new version, got %d", v)
+	}
+	expect("/orders", "c-orders")
+	expect("/users", "")
+	expect("/items", "")
+
+	// back to v2, then keep updating on top of it
+	if err := newc.Rollback(2); err != nil {
+		t.Fatal(err)
+	}
+	expect("/orders", "c-broken")
+	expect("/users", "c-users")
+	newc.OnAddRouter(RouteSpec{ID: "orders", Methods: []string{"GET"}, Path: "/orders", Cluster: "c-fixed"}.toNew())
+	newc.OnAddRouter(RouteSpec{ID: "users-dup", Methods: []string{"GET"}, Path: "/users", Cluster: "c-users-dup"}.toNew())
+	flush(t, newc)
+	expect("/orders", "c-fixed")
+	expect("/users", "c-users")
+	if cs := newc.Conflicts(); len(cs) != 1 || cs[0].Winner != "users" {
+		t.Fatalf("want users-dup shadowed by users, got %+v", cs)
+	}
+
+	// bounded history
+	newc.SetHistoryLimit(3)
+	vs := newc.Versions()
+	if len(vs) != 3 || vs[0].Version != 4 || vs[2].Version != 6 || !vs[2].Active || vs[2].Routes != 3 {
+		t.Fatalf("unexpected history %+v", vs)
+	}
+	if err := newc.Rollback(1); err == nil {
+		t.Fatal("want an error for a version out of history")
+	}
+
+	// revisions only record their changes, the routes of any kept version are rebuilt, pending changes are dropped
+	newc.SetDebounce(time.Hour, 0)
+	newc.OnAddRouter(RouteSpec{ID: "pending", Methods: []string{"GET"}, Path: "/pending", Cluster: "c-pending"}.toNew())
+	newc.OnDeleteRouter(RouteSpec{ID: "orders"}.toNew())
+	if err := newc.Rollback(5); err != nil {
+		t.Fatal(err)
+	}
+	expect("/orders", "c-broken")
+	expect("/users", "c-users")
+	expect("/pending", "")
+	if cs := newc.Conflicts(); len(cs) != 0 {
+		t.Fatalf("unexpected conflicts %+v", cs)
+	}
+	if err := newc.Rollback(6); err != nil {
+		t.Fatal(err)
+	}
+	expect("/orders", "c-fixed")
+	if cs := newc.Conflicts(); len(cs) != 1 || cs[0].Winner != "users" {
+		t.Fatalf("want users-dup shadowed by users, got %+v", cs)
+	}
+	vs = newc.Versions()
+	if len(vs) != 3 || vs[0].Version != 6 || vs[0].Routes != 3 || vs[1].Routes != 2 || vs[2].Routes != 3 {
+		t.Fatalf("unexpected history %+v", vs)
+	}
+	if err := newc.Rollback(6); err != nil {
+		t.Fatal(err)
+	}
+	expect("/orders", "c-fixed")
+	expect("/users", "c-users")
+}
+
+func TestSubscribe_SnapshotEvents(t *testing.T) {
+	newc := buildNew([]RouteSpec{
+		{ID: "orders", Methods: []string{"GET"}, Path: "/orders", Cluster: "c-orders"},
+		{ID: "users", Methods: []string{"GET"}, Path: "/users", Cluster: "c-users"},
+	})
+	events := make(chan newrouter.SnapshotEvent, 8)
+	unsubscribe := newc.Subscribe(func(ev newrouter.SnapshotEvent) {
+		// the coordinator can be used from a subscriber
+		if newc.Version() < ev.Version {
+			t.Errorf("event %d delivered before the switch", ev.Version)
+		}
+		events <- ev
+	})
+	next := func() newrouter.SnapshotEvent {
+		t.Helper()
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+			return newrouter.SnapshotEvent{}
+		}
+	}
+
+	newc.OnAddRouter(RouteSpec{ID: "orders", Methods: []string{"GET"}, Path: "/orders", Cluster: "c-orders-v2"}.toNew())
+	newc.OnDeleteRouter(RouteSpec{ID: "users"}.toNew())
+	newc.OnAddRouter(RouteSpec{ID: "items", Methods: []string{"GET"}, Path: "/items", Cluster: "c-items"}.toNew())
+	newc.OnAddRouter(RouteSpec{ID: "carts", Methods: []string{"GET"}, Path: "/carts", Cluster: "c-carts"}.toNew())
+	ev := next()
+	want := newrouter.SnapshotEvent{Version: 2, Previous: 1, Added: []string{"carts", "items"}, Removed: []string{"users"}, Changed: []string{"orders"}}
+	if ev.BuildDuration <= 0 {
+		t.Fatalf("want a build duration, got %v", ev.BuildDuration)
+	}
+	ev.BuildDuration = 0
+	if !reflect.DeepEqual(ev, want) {
+		t.Fatalf("want %+v, got %+v", want, ev)
+	}
+
+	if err := newc.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+	ev = next()
+	ev.BuildDuration = 0
+	want = newrouter.SnapshotEvent{Version: 3, Previous: 2, Added: []string{"users"}, Removed: []string{"carts", "items"}, Changed: []string{"orders"}, Rollback: true}
+	if !reflect.DeepEqual(ev, want) {
+		t.Fatalf("want %+v, got %+v", want, ev)
+	}
+
+	newc.OnAddVirtualHost(&newmodel.VirtualHost{Name: "api", Domains: []string{"api.example.com"}})
+	if ev = next(); ev.Version != 4 || !ev.VirtualHostsChanged || len(ev.Added)+len(ev.Removed)+len(ev.Changed) != 0 {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+
+	unsubscribe()
+	newc.OnAddRouter(RouteSpec{ID: "late", Methods: []string{"GET"}, Path: "/late", Cluster: "c-late"}.toNew())
+	flush(t, newc)
+	select {
+	case ev := <-events:
+		t.Fatalf("event %d after unsubscribe", ev.Version)
+	default:
+	}
+}
+
+func TestPublish_FlushAndClose(t *testing.T) {
+	newc := buildNew(nil)
+	newc.SetDebounce(time.Hour, 0)
+	newc.OnAddRouter(RouteSpec{ID: "a", Methods: []string{"GET"}, Path: "/a", Cluster: "c-a"}.toNew())
+	if _, err := newc.RouteByPathAndName("/a", "GET"); err == nil {
+		t.Fatal("published before the debounce window")
+	}
+	flush(t, newc)
+	if act, err := newc.RouteByPathAndName("/a", "GET"); err != nil || act.Cluster != "c-a" {
+		t.Fatalf("want c-a after Flush, got %v %v", act, err)
+	}
+	if v := newc.Version(); v != 2 {
+		t.Fatalf("want version 2, got %d", v)
+	}
+	// nothing pending, nothing published
+	flush(t, newc)
+	if v := newc.Version(); v != 2 {
+		t.Fatalf("empty flush published version %d", v)
+	}
+
+	// Close publishes the pending changes and delivers their events
+	events := make(chan uint64, 4)
+	newc.Subscribe(func(ev newrouter.SnapshotEvent) { events <- ev.Version })
+	newc.OnAddRouter(RouteSpec{ID: "b", Methods: []string{"GET"}, Path: "/b", Cluster: "c-b"}.toNew())
+	if err := newc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if act, err := newc.RouteByPathAndName("/b", "GET"); err != nil || act.Cluster != "c-b" {
+		t.Fatalf("want c-b after Close, got %v %v", act, err)
+	}
+	select {
+	case v := <-events:
+		if v != 3 {
+			t.Fatalf("want event 3, got %d", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event of the last publish lost by Close")
+	}
+	// changes after Close are published immediately
+	newc.OnAddRouter(RouteSpec{ID: "c", Methods: []string{"GET"}, Path: "/c", Cluster: "c-c"}.toNew())
+	if act, err := newc.RouteByPathAndName("/c", "GET"); err != nil || act.Cluster != "c-c" {
+		t.Fatalf("want c-c after Close, got %v %v", act, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := buildNew(nil).Flush(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestPublish_MaxDelay(t *testing.T) {
+	newc := buildNew(nil)
+	defer newc.Close()
+	newc.SetDebounce(50*time.Millisecond, 150*time.Millisecond)
+	// Close publishes the changes left after the test returns, later events are dropped
+	published := make(chan struct{}, 1)
+	newc.Subscribe(func(newrouter.SnapshotEvent) {
+		select {
+		case published <- struct{}{}:
+		default:
+		}
+	})
+
+	// a change every 20ms keeps sliding the debounce window, the max delay publishes anyway
+	start := time.Now()
+	tick := time.NewTicker(20 * time.Millisecond)
+	defer tick.Stop()
+	for i := 0; ; i++ {
+		newc.OnAddRouter(RouteSpec{ID: "r" + strconv.Itoa(i), Methods: []string{"GET"}, Path: "/r" + strconv.Itoa(i), Cluster: "c"}.toNew())
+		select {
+		case <-published:
+			if d := time.Since(start); d < 150*time.Millisecond {
+				t.Fatalf("published after %v, before the max delay", d)
+			}
+			return
+		case <-tick.C:
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("a stream of changes postponed the publish")
+		}
+	}
+}
+
+func TestTx_AtomicBatch(t *testing.T) {
+	newc := buildNew([]RouteSpec{
+		{ID: "orders-v1", Methods: []string{"GET"}, Path: "/orders", Cluster: "c-orders"},
+		{ID: "users", Methods: []string{"GET"}, Path: "/users", Cluster: "c-users"},
+	})
+	defer newc.Close()
+	newc.SetDebounce(time.Hour, 0)
+	events := make(chan newrouter.SnapshotEvent, 4)
+	newc.Subscribe(func(ev newrouter.SnapshotEvent) { events <- ev })
+
+	// a rename and an update land in one snapshot
+	tx := newc.Begin()
+	_ = tx.Apply(
+		newrouter.RouteChange{Delete: "orders-v1"},
+		newrouter.RouteChange{Route: RouteSpec{ID: "orders-v2", Methods: []string{"GET"}, Path: "/orders", Cluster: "c-orders-v2"}.toNew()},
+	)
+	if act, err := newc.RouteByPathAndName("/orders", "GET"); err != nil || act.Cluster != "c-orders" {
+		t.Fatalf("staged change visible before Commit: %v %v", act, err)
+	}
+	_ = tx.Apply(newrouter.RouteChange{Route: RouteSpec{ID: "users", Methods: []string{"GET"}, Path: "/users", Cluster: "c-users-v2"}.toNew()})
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if act, err := newc.RouteByPathAndName("/orders", "GET"); err != nil || act.Cluster != "c-orders-v2" {
+		t.Fatalf("want c-orders-v2, got %v %v", act, err)
+	}
+	if act, err := newc.RouteByPathAndName("/users", "GET"); err != nil || act.Cluster != "c-users-v2" {
+		t.Fatalf("want c-users-v2, got %v %v", act, err)
+	}
+	if v := newc.Version(); v != 2 {
+		t.Fatalf("want one snapshot for the batch, got version %d", v)
+	}
+	select {
+	case ev := <-events:
+		if !reflect.DeepEqual(ev.Removed, []string{"orders-v1"}) || !reflect.DeepEqual(ev.Added, []string{"orders-v2"}) || !reflect.DeepEqual(ev.Changed, []string{"users"}) {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	if err := tx.Commit(); !errors.Is(err, newrouter.ErrTxDone) {
+		t.Fatalf("want ErrTxDone, got %v", err)
+	}
+
+	// one invalid route and nothing is applied
+	tx = newc.Begin()
+	_ = tx.Apply(
+		newrouter.RouteChange{Delete: "users"},
+		newrouter.RouteChange{Route: RouteSpec{ID: "items", Methods: []string{"GET"}, Path: "/items", Cluster: "c-items"}.toNew()},
+		newrouter.RouteChange{Host: "api", Route: RouteSpec{ID: "bad", Methods: []string{"GET"}, Path: "/**/bad", Cluster: "c-bad"}.toNew()},
+	)
+	var errs newmodel.ValidationErrors
+	if err := tx.Commit(); !errors.As(err, &errs) || len(errs) != 1 || errs[0].RouteID != "bad" || errs[0].VirtualHost != "api" {
+		t.Fatalf("want the error of route bad, got %v", err)
+	}
+	flush(t, newc)
+	if v := newc.Version(); v != 2 {
+		t.Fatalf("rejected batch published version %d", v)
+	}
+	if act, err := newc.RouteByPathAndName("/users", "GET"); err != nil || act.Cluster != "c-users-v2" {
+		t.Fatalf("want c-users-v2, got %v %v", act, err)
+	}
+	if _, err := newc.RouteByPathAndName("/items", "GET"); err == nil {
+		t.Fatal("route of a rejected batch published")
+	}
+
+	// a discarded batch is dropped
+	tx = newc.Begin()
+	_ = tx.Apply(newrouter.RouteChange{Delete: "users"})
+	tx.Discard()
+	if err := tx.Apply(newrouter.RouteChange{Delete: "orders-v2"}); !errors.Is(err, newrouter.ErrTxDone) {
+		t.Fatalf("want ErrTxDone, got %v", err)
+	}
+	flush(t, newc)
+	if v := newc.Version(); v != 2 {
+		t.Fatalf("discarded batch published version %d", v)
+	}
+}
+
+func TestUpdateRouter_ReplaceSemantics(t *testing.T) {
+	newc := buildNew([]RouteSpec{
+		{ID: "user", Methods: []string{"GET"}, Path: "/users/:id", Cluster: "c-user"},
+		{ID: "user-canary", Methods: []string{"GET"}, Path: "/users/:uid", Headers: []HeaderSpec{{Name: "X-Canary", Values: []string{"1"}}}, Cluster: "c-canary"},
+		{ID: "user-dup", Methods: []string{"GET"}, Path: "/users/:id", Cluster: "c-dup"},
+		{ID: "hdr", Methods: []string{"GET"}, Headers: []HeaderSpec{{Name: "X-Env", Values: []string{"prod"}}}, Cluster: "c-hdr"},
+		{ID: "re", Methods: []string{"GET"}, Regex: `/legacy/(?P<rest>.+)`, Cluster: "c-legacy"},
+	})
+	defer newc.Close()
+	route := func(path string, hdr map[string]string) *newmodel.MatchResult {
+		t.Helper()
+		req, _ := http.NewRequest("GET", path, nil)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		res, err := newc.MatchRoute(req)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		return res
+	}
+
+	if u := newc.OnUpdateRouter(RouteSpec{ID: "missing", Methods: []string{"GET"}, Path: "/missing", Cluster: "c"}.toNew()); u.Existed {
+		t.Fatalf("unexpected %+v", u)
+	}
+	if u := newc.OnUpdateRouter(RouteSpec{ID: "user", Methods: []string{"GET"}, Path: "/users/:id", Cluster: "c-user"}.toNew()); !u.Existed || u.MatchChanged || u.ActionChanged {
+		t.Fatalf("unexpected %+v", u)
+	}
+	flush(t, newc)
+	if v := newc.Version(); v != 1 {
+		t.Fatalf("updates without change published version %d", v)
+	}
+
+	// action only: swapped in place, conditions, position and conflicts kept
+	for _, s := range []RouteSpec{
+		{ID: "user", Methods: []string{"GET"}, Path: "/users/:id", Cluster: "c-user-v2"},
+		{ID: "hdr", Methods: []string{"GET"}, Headers: []HeaderSpec{{Name: "X-Env", Values: []string{"prod"}}}, Cluster: "c-hdr-v2"},
+		{ID: "re", Methods: []string{"GET"}, Regex: `/legacy/(?P<rest>.+)`, Cluster: "c-legacy-v2"},
+	} {
+		if u := newc.OnUpdateRouter(s.toNew()); !u.Existed || u.MatchChanged || !u.ActionChanged {
+			t.Fatalf("%s: unexpected %+v", s.ID, u)
+		}
+	}
+	flush(t, newc)
+	if res := route("/users/7", nil); res.RouteID != "user" || res.Action.Cluster != "c-user-v2" || res.Params["id"] != "7" {
+		t.Fatalf("unexpected %+v", res)
+	}
+	if res := route("/users/7", map[string]string{"X-Canary": "1"}); res.RouteID != "user-canary" || res.Params["uid"] != "7" {
+		t.Fatalf("unexpected %+v", res)
+	}
+	if res := route("/x", map[string]string{"X-Env": "prod"}); res.Action.Cluster != "c-hdr-v2" {
+		t.Fatalf("unexpected %+v", res)
+	}
+	if res := route("/legacy/a/b", nil); res.Action.Cluster != "c-legacy-v2" || res.Params["rest"] != "a/b" {
+		t.Fatalf("unexpected %+v", res)
+	}
+	if cs := newc.Conflicts(); len(cs) != 1 || !reflect.DeepEqual(cs[0].Duplicates, []string{"user-dup"}) {
+		t.Fatalf("unexpected conflicts %+v", cs)
+	}
+
+	// match change: the route moves, an action change of a route pending a move is not swapped
+	u := newc.OnUpdateRouter(RouteSpec{ID: "user", Methods: []string{"GET"}, Path: "/people/:id", Cluster: "c-user-v2"}.toNew())
+	if !u.Existed || !u.MatchChanged || u.ActionChanged {
+		t.Fatalf("unexpected %+v", u)
+	}
+	newc.OnUpdateRouter(RouteSpec{ID: "user", Methods: []string{"GET"}, Path: "/people/:id", Cluster: "c-user-v3"}.toNew())
+	flush(t, newc)
+	if res := route("/people/7", nil); res.RouteID != "user" || res.Action.Cluster != "c-user-v3" {
+		t.Fatalf("unexpected %+v", res)
+	}
+	if res := route("/users/7", nil); res.RouteID != "user-dup" {
+		t.Fatalf("unexpected %+v", res)
+	}
+	if cs := newc.Conflicts(); len(cs) != 0 {
+		t.Fatalf("unexpected conflicts %+v", cs)
+	}
+
+	// an invalid action drops the route, the next valid one brings it back
+	invalid := RouteSpec{ID: "user-dup", Methods: []string{"GET"}, Path: "/users/:id"}.toNew()
+	invalid.Route.Redirect = &newmodel.RedirectAction{ResponseCode: http.StatusOK}
+	newc.OnUpdateRouter(invalid)
+	flush(t, newc)
+	if res := route("/users/7", map[string]string{"X-Canary": "1"}); res.RouteID != "user-canary" {
+		t.Fatalf("unexpected %+v", res)
+	}
+	req, _ := http.NewRequest("GET", "/users/7", nil)
+	if _, err := newc.Route(req); err == nil {
+		t.Fatal("route with an invalid action still served")
+	}
+	newc.OnUpdateRouter(RouteSpec{ID: "user-dup", Methods: []string{"GET"}, Path: "/users/:id", Cluster: "c-dup-v2"}.toNew())
+	flush(t, newc)
+	if res := route("/users/7", nil); res.RouteID != "user-dup" || res.Action.Cluster != "c-dup-v2" {
+		t.Fatalf("unexpected %+v", res)
+	}
+
+	// the route handed over modified in place and passed again: reported as changed and placed again
+	same := RouteSpec{ID: "user-dup", Methods: []string{"GET"}, Path: "/users/:id", Cluster: "c-dup-v3"}.toNew()
+	newc.OnUpdateRouter(same)
+	flush(t, newc)
+	same.Route.Cluster = "c-dup-v4"
+	if u := newc.OnUpdateRouter(same); !u.Existed || !u.MatchChanged || !u.ActionChanged {
+		t.Fatalf("unexpected %+v", u)
+	}
+	flush(t, newc)
+	if res := route("/users/7", nil); res.RouteID != "user-dup" || res.Action.Cluster != "c-dup-v4" {
+		t.Fatalf("unexpected %+v", res)
+	}
+	same.Match.Path = "/members/:id"
+	newc.OnUpdateRouter(same)
+	flush(t, newc)
+	if res := route("/members/7", nil); res.RouteID != "user-dup" || res.Params["id"] != "7" {
+		t.Fatalf("unexpected %+v", res)
+	}
+	req, _ = http.NewRequest("GET", "/users/7", nil)
+	if _, err := newc.Route(req); err == nil {
+		t.Fatal("moved route still served at its previous path")
+	}
+}
+
+func TestRoute_ZeroAllocs(t *testing.T) {
+	wc := newmodel.WeightedClusters{Clusters: []newmodel.WeightedCluster{{Name: "stable", Weight: 90}, {Name: "canary", Weight: 10}}}
+	weighted := RouteSpec{ID: "weighted", Methods: []string{"GET"}, Path: "/split"}.toNew()
+	weighted.Route.WeightedClusters = &wc
+	routes := []*newmodel.Router{
+		RouteSpec{ID: "static", Methods: []string{"GET"}, Path: "/api/v1/items", Cluster: "c-static"}.toNew(),
+		RouteSpec{ID: "vars", Methods: []string{"GET"}, Path: "/shops/:shop/orders/:order", Cluster: "c-vars"}.toNew(),
+		RouteSpec{ID: "prefix", Methods: []string{"GET"}, Prefix: "/static/", Cluster: "c-prefix"}.toNew(),
+		weighted,
+	}
+	newc := newrouter.CreateRouterCoordinator(&newmodel.RouteConfiguration{Routes: routes})
+
+	for _, path := range []string{"/api/v1/items", "/shops/1/orders/2?x=1", "/static/css/site.css", "/split", "/missing"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		if n := testing.AllocsPerRun(100, func() { _, _ = newc.Route(req) }); n != 0 {
+			t.Errorf("Route %s: %v allocs", path, n)
+		}
+		if n := testing.AllocsPerRun(100, func() { _, _ = newc.RouteByPathAndName(path, "GET") }); n != 0 {
+			t.Errorf("RouteByPathAndName %s: %v allocs", path, n)
+		}
+	}
+
+	// the action is the one of the snapshot, the values written to the pooled buffer are not retained
+	req, _ := http.NewRequest("GET", "/api/v1/items", nil)
+	a1, _ := newc.Route(req)
+	a2, _ := newc.Route(req)
+	if a1 != a2 || a1.Cluster != "c-static" {
+		t.Fatalf("Route: want the shared action of c-static, got %p %p %v", a1, a2, a1)
+	}
+	m, err := newc.MatchRouteByPathAndName("/shops/1/orders/2", "GET")
+	if err != nil || m.Params["shop"] != "1" || m.Params["order"] != "2" {
+		t.Fatalf("MatchRouteByPathAndName: %v %v", m, err)
+	}
+}
+
 /* ==============================
    random data fuzz test
    ============================== */
@@ -300,6 +1928,88 @@ func TestParity_Randomized(t *testing.T) {
 	}
 }
 
+func TestIncrementalReload_MatchesFullBuild(t *testing.T) {
+	syntax = colonSyntax()
+	const seed int64 = 20251016
+
+	base := genRandomSpecsWithVars(syntax, 5000, 0.40, 0.10, seed)
+	incr := buildNew(base)
+
+	// delete ~5%, update clusters in place of ~5%, add fresh routes at the end
+	rnd := rand.New(rand.NewSource(seed))
+	final := make([]RouteSpec, 0, len(base)+300)
+	for _, s := range base {
+		switch rnd.Intn(20) {
+		case 0:
+			incr.OnDeleteRouter(s.toNew())
+			continue
+		case 1:
+			s.Cluster += "-updated"
+			incr.OnAddRouter(s.toNew())
+		}
+		final = append(final, s)
+	}
+	for i := 0; i < 300; i++ {
+		s := RouteSpec{ID: "fresh-" + strconv.Itoa(i), Methods: []string{"GET", "POST"}, Cluster: "c-fresh-" + strconv.Itoa(i)}
+		switch i % 3 {
+		case 0:
+			s.Path = "/api/v1/item/fresh-" + strconv.Itoa(i)
+		case 1:
+			s.Prefix = "/api/v" + strconv.Itoa(1+i%3) + "/fresh" + strconv.Itoa(i) + "/"
+		default:
+			s.Headers = []HeaderSpec{{Name: "X-Env", Values: []string{"prod"}}}
+		}
+		incr.OnAddRouter(s.toNew())
+		final = append(final, s)
+	}
+	flush(t, incr)
+
+	full := buildNew(final)
+	reqs := genRandomRequests(5000, seed+1)
+	for i := 0; i < 300; i++ {
+		req, _ := http.NewRequest("GET", "/api/v1/item/fresh-"+strconv.Itoa(i), nil)
+		reqs = append(reqs, req)
+	}
+	for i, req := range reqs {
+		ia, ie := incr.Route(req)
+		fa, fe := full.Route(req)
+		if (ie == nil) != (fe == nil) || (ie == nil && ia.Cluster != fa.Cluster) {
+			t.Fatalf("incremental mismatch at #%d: %s %s incr={%v %v} full={%v %v}", i, req.Method, req.URL.Path, ia, ie, fa, fe)
+		}
+	}
+}
+
+func TestIncrementalReload_DuplicateIDsKeepLast(t *testing.T) {
+	// the last route of an id replaces the earlier ones, as if it was added after them
+	newc := buildNew([]RouteSpec{
+		{ID: "x", Methods: []string{"GET"}, Path: "/a", Cluster: "xa"},
+		{ID: "x", Methods: []string{"GET"}, Path: "/b", Cluster: "xb"},
+	})
+	check := func(path, want string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", path, nil)
+		act, err := newc.Route(req)
+		switch {
+		case want == "" && err == nil:
+			t.Fatalf("%s: want no route, got %q", path, act.Cluster)
+		case want != "" && (err != nil || act.Cluster != want):
+			t.Fatalf("%s: want %q, got %v %v", path, want, act, err)
+		}
+	}
+	check("/a", "")
+	check("/b", "xb")
+
+	newc.OnAddRouter(RouteSpec{ID: "y", Methods: []string{"GET"}, Path: "/a", Cluster: "ya"}.toNew())
+	flush(t, newc)
+	check("/a", "ya")
+	check("/b", "xb")
+
+	newc.OnDeleteRouter(RouteSpec{ID: "x"}.toNew())
+	flush(t, newc)
+	check("/a", "ya")
+	check("/b", "")
+}
+
 func headerFromReq(r *http.Request) map[string]string {
 	if len(r.Header) == 0 {
 		return nil
@@ -0,0 +1,46 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stringutil
+
+import (
+	"regexp"
+	"sync"
+)
+
+var regexCache sync.Map // map[string]*regexp.Regexp
+
+// GetCachedRegexp compile pat once and share it across snapshots, returns nil if pat is invalid
+func GetCachedRegexp(pat string) *regexp.Regexp {
+	if v, ok := regexCache.Load(pat); ok {
+		return v.(*regexp.Regexp)
+	}
+	// Compile 失败就返回 nil（调用方会忽略该正则）
+	re, err := regexp.Compile(pat)
+	if err != nil {
+		return nil
+	}
+	if v, ok := regexCache.LoadOrStore(pat, re); ok {
+		return v.(*regexp.Regexp)
+	}
+	return re
+}
+
+// GetCachedAnchoredRegexp like GetCachedRegexp, the regexp must match the whole input (a path segment, a path)
+func GetCachedAnchoredRegexp(pat string) *regexp.Regexp {
+	return GetCachedRegexp("^(?:" + pat + ")$")
+}
@@ -32,9 +32,19 @@ func Split(path string) []string {
 	return strings.Split(strings.TrimLeft(path, "/"), "/")
 }
 
-// VariableName extract VariableName      (:id, name = id)
+// VariableName extract VariableName      (:id, name = id)  (:id(\d+), name = id)
 func VariableName(key string) string {
-	return strings.TrimPrefix(key, ":")
+	name, _ := VariableConstraint(key)
+	return name
+}
+
+// VariableConstraint extract VariableName and its regex constraint      (:id(\d+), name = id, constraint = \d+)
+func VariableConstraint(key string) (string, string) {
+	key = strings.TrimPrefix(key, ":")
+	if i := strings.IndexByte(key, '('); i > 0 && key[len(key)-1] == ')' {
+		return key[:i], key[i+1 : len(key)-1]
+	}
+	return key, ""
 }
 
 // IsPathVariableOrWildcard return if is a PathVariable     (:id, true)
@@ -62,7 +72,12 @@ func IsMatchAll(key string) bool {
 	return key == "**"
 }
 
+// GetTrieKey method qualified key of a request path, the query string starts at the first '?'
 func GetTrieKey(method string, path string) string {
+	return trieKey(method, path, cutQuery)
+}
+
+func trieKey(method string, path string, cut func(string) string) string {
 	// "http://localhost:8882/api/v1/test-dubbo/user?name=tc/"
 	ret := ""
 
@@ -84,20 +99,63 @@ func GetTrieKey(method string, path string) string {
 	}
 	// "METHOD/api/v1/test-dubbo/user?name=tc"
 
-	ret = strings.Split(ret, "?")[0]
+	ret = cut(ret)
 	// "METHOD/api/v1/test-dubbo/user"
 	return ret
 }
 
+// TrieKeyPath the part of GetTrieKey(method, path) after the method, without building the key:
+// the key is method + "/" + rest when ok, method alone otherwise
+func TrieKeyPath(path string) (rest string, ok bool) {
+	if i := strings.Index(path, "://"); i >= 0 {
+		path = path[i+len("://"):]
+		path = path[strings.Index(path, "/")+1:]
+	}
+	path = strings.TrimPrefix(path, "/")
+	if path == "" {
+		return "", false
+	}
+	path = strings.TrimSuffix(path, "/")
+	return cutQuery(path), true
+}
+
+// cutQuery cut the query string of a request path at the first '?'
+func cutQuery(path string) string {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
+
+// cutPatternQuery cut the query string of a route pattern, a '?' inside the regex constraint of a path variable (:id(\d+)?) is kept
+func cutPatternQuery(path string) string {
+	depth := 0
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+			}
+		case '?':
+			if depth == 0 {
+				return path[:i]
+			}
+		}
+	}
+	return path
+}
+
 func GetTrieKeyWithPrefix(method, path, prefix string, isPrefix bool) string {
 	if isPrefix {
 		if prefix != "" && prefix[len(prefix)-1] != '/' {
 			prefix += "/"
 		}
 		prefix += "**"
-		return GetTrieKey(method, prefix)
+		return trieKey(method, prefix, cutPatternQuery)
 	}
-	return GetTrieKey(method, path)
+	return trieKey(method, path, cutPatternQuery)
 }
 
 func GetIPAndPort(address string) ([]*net.TCPAddr, error) {